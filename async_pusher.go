@@ -0,0 +1,206 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "log"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// OverflowPolicy decides what an AsyncPusher does with a log part when its
+// queue is full. As a flag it is one of drop-oldest, drop-newest or block.
+type OverflowPolicy int
+
+const (
+    DropOldest OverflowPolicy = iota
+    DropNewest
+    Block
+)
+
+func (p *OverflowPolicy) String() string {
+    switch *p {
+    case DropNewest:
+        return "drop-newest"
+    case Block:
+        return "block"
+    }
+    return "drop-oldest"
+}
+
+func (p *OverflowPolicy) Set(value string) error {
+    switch value {
+    case "drop-oldest":
+        *p = DropOldest
+    case "drop-newest":
+        *p = DropNewest
+    case "block":
+        *p = Block
+    default:
+        return fmt.Errorf("unknown overflow policy %q, expected drop-oldest, drop-newest or block", value)
+    }
+    return nil
+}
+
+// AsyncPusher queues log parts and publishes them to pusher from a pool of
+// workers, so that storing and acking log parts doesn't wait for the live
+// streams. The parts of a job always go to the same worker to keep them in
+// order, each worker has its share of the queue.
+//
+// Publish only fails when the policy is Block and ctx is done before there
+// is room in the queue, failures of the publishes themselves are logged and
+// counted.
+type AsyncPusher struct {
+    pusher  Pusher
+    policy  OverflowPolicy
+    timeout time.Duration
+    retry   RetryPolicy
+    queues  []chan PusherPayload
+    depth   int64
+    closing chan struct{}
+    wg      sync.WaitGroup
+}
+
+// NewAsyncPusher starts workers publishing to pusher from a queue of size log
+// parts, timeout and retry apply to every publish.
+func NewAsyncPusher(pusher Pusher, size int, workers int, policy OverflowPolicy, timeout time.Duration, retry RetryPolicy) *AsyncPusher {
+    if workers < 1 {
+        workers = 1
+    }
+
+    queueSize := size / workers
+    if queueSize < 1 {
+        queueSize = 1
+    }
+
+    ap := &AsyncPusher{
+        pusher:  pusher,
+        policy:  policy,
+        timeout: timeout,
+        retry:   retry,
+        queues:  make([]chan PusherPayload, workers),
+        closing: make(chan struct{}),
+    }
+
+    ap.wg.Add(workers)
+    for i := range ap.queues {
+        ap.queues[i] = make(chan PusherPayload, queueSize)
+        go ap.work(ap.queues[i])
+    }
+
+    return ap
+}
+
+func (ap *AsyncPusher) Publish(ctx context.Context, jobId int, number int, content string, final bool) error {
+    payload := PusherPayload{
+        JobId:   jobId,
+        Number:  number,
+        Content: content,
+        Final:   final,
+    }
+
+    select {
+    case <-ap.closing:
+        ap.drop()
+        return nil
+    default:
+    }
+
+    queue := ap.queues[uint(jobId)%uint(len(ap.queues))]
+
+    switch ap.policy {
+    case DropNewest:
+        select {
+        case queue <- payload:
+            ap.updateDepth(1)
+        default:
+            ap.drop()
+        }
+    case DropOldest:
+        for {
+            select {
+            case queue <- payload:
+                ap.updateDepth(1)
+                return nil
+            default:
+            }
+
+            select {
+            case <-queue:
+                ap.updateDepth(-1)
+                ap.drop()
+            default:
+            }
+        }
+    case Block:
+        select {
+        case queue <- payload:
+            ap.updateDepth(1)
+        case <-ctx.Done():
+            ap.drop()
+            return &PusherPublishError{ctx.Err(), true}
+        }
+    }
+
+    return nil
+}
+
+// Queued reports that publishing only queues the log parts.
+func (ap *AsyncPusher) Queued() bool {
+    return true
+}
+
+// Close publishes the log parts still queued and stops the workers, later
+// log parts are dropped.
+func (ap *AsyncPusher) Close() {
+    close(ap.closing)
+    ap.wg.Wait()
+}
+
+func (ap *AsyncPusher) work(queue chan PusherPayload) {
+    defer ap.wg.Done()
+
+    for {
+        select {
+        case payload := <-queue:
+            ap.publish(payload)
+        case <-ap.closing:
+            for {
+                select {
+                case payload := <-queue:
+                    ap.publish(payload)
+                default:
+                    return
+                }
+            }
+        }
+    }
+}
+
+func (ap *AsyncPusher) publish(payload PusherPayload) {
+    ap.updateDepth(-1)
+
+    err := ap.retry.Do(context.Background(), "pusher_queue", func() error {
+        ctx, cancel := context.WithTimeout(context.Background(), ap.timeout)
+        defer cancel()
+
+        var err error
+        appMetrics.TimePusher(func() {
+            err = ap.pusher.Publish(ctx, payload.JobId, payload.Number, payload.Content, payload.Final)
+        })
+        return err
+    })
+
+    if countPusherError(err) {
+        log.Printf("publish: error publishing log part %d of job %d - %v", payload.Number, payload.JobId, err)
+    }
+}
+
+func (ap *AsyncPusher) updateDepth(delta int64) {
+    appMetrics.UpdatePusherQueueDepth(atomic.AddInt64(&ap.depth, delta))
+}
+
+func (ap *AsyncPusher) drop() {
+    appMetrics.MarkDroppedPusherQueueCount()
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "log"
+    "time"
+)
+
+var errBatcherClosed = errors.New("log part batcher closed")
+
+// BatchingDB is a DB which hands log parts to a LogPartBatcher instead of
+// inserting them one by one. CreateLogPart still only returns once the part
+// has been committed, so the message is not acked before that.
+type BatchingDB struct {
+    DB
+    batcher *LogPartBatcher
+}
+
+func NewBatchingDB(db DB, batcher *LogPartBatcher) DB {
+    return &BatchingDB{db, batcher}
+}
+
+func (db *BatchingDB) CreateLogPart(ctx context.Context, logId int, number int, content string, final bool) (bool, error) {
+    return db.batcher.Add(ctx, LogPart{logId, number, content, final})
+}
+
+// LogPartBatcher collects the log parts of all processors and writes them
+// with COPY, in batches of up to maxSize parts or whatever arrived within
+// maxWait of the first part of a batch.
+type LogPartBatcher struct {
+    db      DB
+    maxSize int
+    maxWait time.Duration
+    timeout time.Duration
+    parts   chan *batchedLogPart
+    closing chan struct{}
+    done    chan struct{}
+}
+
+type batchedLogPart struct {
+    part   LogPart
+    result chan batchResult
+}
+
+type batchResult struct {
+    created bool
+    err     error
+}
+
+// NewLogPartBatcher starts a batcher writing to db. Each flush has to finish
+// within timeout.
+func NewLogPartBatcher(db DB, maxSize int, maxWait time.Duration, timeout time.Duration) *LogPartBatcher {
+    b := &LogPartBatcher{
+        db:      db,
+        maxSize: maxSize,
+        maxWait: maxWait,
+        timeout: timeout,
+        parts:   make(chan *batchedLogPart, maxSize),
+        closing: make(chan struct{}),
+        done:    make(chan struct{}),
+    }
+
+    go b.run()
+
+    return b
+}
+
+// Add queues a log part and waits until the batch it ended up in has been
+// written, reporting whether the part was new. When ctx is done first the
+// part may still be written later.
+func (b *LogPartBatcher) Add(ctx context.Context, part LogPart) (bool, error) {
+    bp := &batchedLogPart{part, make(chan batchResult, 1)}
+
+    select {
+    case b.parts <- bp:
+    case <-b.closing:
+        return false, &DBError{"CreateLogPart", errBatcherClosed}
+    case <-ctx.Done():
+        return false, &DBError{"CreateLogPart", ctx.Err()}
+    }
+
+    select {
+    case result := <-bp.result:
+        return result.created, result.err
+    case <-ctx.Done():
+        return false, &DBError{"CreateLogPart", ctx.Err()}
+    }
+}
+
+// Close writes the parts queued so far and stops the batcher, parts added
+// afterwards fail.
+func (b *LogPartBatcher) Close() {
+    close(b.closing)
+    <-b.done
+}
+
+func (b *LogPartBatcher) run() {
+    defer close(b.done)
+
+    for {
+        var batch []*batchedLogPart
+
+        select {
+        case bp := <-b.parts:
+            batch = append(batch, bp)
+        case <-b.closing:
+            b.flushQueued()
+            return
+        }
+
+        timer := time.NewTimer(b.maxWait)
+
+    collect:
+        for len(batch) < b.maxSize {
+            select {
+            case bp := <-b.parts:
+                batch = append(batch, bp)
+            case <-timer.C:
+                break collect
+            case <-b.closing:
+                break collect
+            }
+        }
+        timer.Stop()
+
+        b.flush(batch)
+    }
+}
+
+// flushQueued writes the parts which were queued before the batcher closed.
+func (b *LogPartBatcher) flushQueued() {
+    for {
+        var batch []*batchedLogPart
+
+    collect:
+        for len(batch) < b.maxSize {
+            select {
+            case bp := <-b.parts:
+                batch = append(batch, bp)
+            default:
+                break collect
+            }
+        }
+
+        if len(batch) == 0 {
+            return
+        }
+
+        b.flush(batch)
+    }
+}
+
+func (b *LogPartBatcher) flush(batch []*batchedLogPart) {
+    parts := make([]LogPart, len(batch))
+    for i, bp := range batch {
+        parts[i] = bp.part
+    }
+
+    var created []bool
+    var err error
+    appMetrics.TimeLogPartBatchFlush(len(parts), func() {
+        ctx, cancel := context.WithTimeout(context.Background(), b.timeout)
+        defer cancel()
+
+        created, err = b.db.CreateLogParts(ctx, parts)
+    })
+
+    if err == nil {
+        for i, bp := range batch {
+            bp.result <- batchResult{created[i], nil}
+        }
+        return
+    }
+
+    if isTransientError(err) {
+        log.Printf("flush: error writing a batch of %d log part(s) - %v", len(parts), err)
+
+        for _, bp := range batch {
+            bp.result <- batchResult{false, err}
+        }
+        return
+    }
+
+    // a single bad part fails the whole COPY, write the parts one by one so
+    // that only the bad ones fail
+    log.Printf("flush: error writing a batch of %d log part(s), writing them one by one - %v", len(parts), err)
+
+    for _, bp := range batch {
+        ctx, cancel := context.WithTimeout(context.Background(), b.timeout)
+        created, err := b.db.CreateLogPart(ctx, bp.part.LogId, bp.part.Number, bp.part.Content, bp.part.Final)
+        bp.result <- batchResult{created, err}
+        cancel()
+    }
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+    "container/list"
+    "context"
+    "sync"
+    "time"
+)
+
+// CachingDB is a DB which looks log ids up in a LogIdCache first, a job
+// produces hundreds of log parts which all belong to the same log.
+type CachingDB struct {
+    DB
+    cache *LogIdCache
+}
+
+func NewCachingDB(db DB, cache *LogIdCache) DB {
+    return &CachingDB{db, cache}
+}
+
+func (db *CachingDB) FindLogId(ctx context.Context, jobId int) (int, error) {
+    if logId, found, ok := db.cache.Get(jobId); ok {
+        appMetrics.MarkLogIdCacheHit()
+        if !found {
+            return 0, &LogNotFoundError{jobId}
+        }
+        return logId, nil
+    }
+
+    appMetrics.MarkLogIdCacheMiss()
+
+    logId, err := db.DB.FindLogId(ctx, jobId)
+    switch err.(type) {
+    case nil:
+        db.cache.Add(jobId, logId)
+    case *LogNotFoundError:
+        db.cache.AddMissing(jobId)
+    }
+
+    return logId, err
+}
+
+func (db *CachingDB) FindOrCreateLogId(ctx context.Context, jobId int) (int, bool, error) {
+    logId, created, err := db.DB.FindOrCreateLogId(ctx, jobId)
+    if err == nil {
+        db.cache.Add(jobId, logId)
+    }
+
+    return logId, created, err
+}
+
+// LogIdCache is a bounded LRU cache of job ids to log ids, safe for use by
+// multiple goroutines. Entries expire after a TTL; jobs without a log are
+// cached as well, but with a shorter TTL as their log is usually about to be
+// created.
+type LogIdCache struct {
+    mu          sync.Mutex
+    size        int
+    ttl         time.Duration
+    negativeTTL time.Duration
+    entries     map[int]*list.Element
+    order       *list.List
+}
+
+type logIdCacheEntry struct {
+    jobId   int
+    logId   int
+    found   bool
+    expires time.Time
+}
+
+func NewLogIdCache(size int, ttl time.Duration, negativeTTL time.Duration) *LogIdCache {
+    return &LogIdCache{
+        size:        size,
+        ttl:         ttl,
+        negativeTTL: negativeTTL,
+        entries:     map[int]*list.Element{},
+        order:       list.New(),
+    }
+}
+
+// Get returns the cached log id for a job, whether the job has a log, and
+// whether there was an unexpired entry for the job at all.
+func (c *LogIdCache) Get(jobId int) (int, bool, bool) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    element, ok := c.entries[jobId]
+    if !ok {
+        return 0, false, false
+    }
+
+    entry := element.Value.(*logIdCacheEntry)
+    if time.Now().After(entry.expires) {
+        c.remove(element)
+        return 0, false, false
+    }
+
+    c.order.MoveToFront(element)
+
+    return entry.logId, entry.found, true
+}
+
+func (c *LogIdCache) Add(jobId int, logId int) {
+    c.add(&logIdCacheEntry{jobId, logId, true, time.Now().Add(c.ttl)})
+}
+
+func (c *LogIdCache) AddMissing(jobId int) {
+    if c.negativeTTL <= 0 {
+        return
+    }
+
+    c.add(&logIdCacheEntry{jobId, 0, false, time.Now().Add(c.negativeTTL)})
+}
+
+func (c *LogIdCache) add(entry *logIdCacheEntry) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    if element, ok := c.entries[entry.jobId]; ok {
+        element.Value = entry
+        c.order.MoveToFront(element)
+        return
+    }
+
+    c.entries[entry.jobId] = c.order.PushFront(entry)
+
+    for c.order.Len() > c.size {
+        c.remove(c.order.Back())
+    }
+}
+
+func (c *LogIdCache) remove(element *list.Element) {
+    c.order.Remove(element)
+    delete(c.entries, element.Value.(*logIdCacheEntry).jobId)
+}
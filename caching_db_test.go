@@ -0,0 +1,135 @@
+package main
+
+import (
+    "context"
+    "testing"
+    "time"
+)
+
+// countingDB finds the logs in logIds, counting the lookups.
+type countingDB struct {
+    DB
+    logIds  map[int]int
+    lookups int
+}
+
+func (db *countingDB) FindLogId(ctx context.Context, jobId int) (int, error) {
+    db.lookups++
+
+    logId, ok := db.logIds[jobId]
+    if !ok {
+        return 0, &LogNotFoundError{jobId}
+    }
+    return logId, nil
+}
+
+func (db *countingDB) FindOrCreateLogId(ctx context.Context, jobId int) (int, bool, error) {
+    if logId, ok := db.logIds[jobId]; ok {
+        return logId, false, nil
+    }
+
+    db.logIds[jobId] = 100 + jobId
+    return db.logIds[jobId], true, nil
+}
+
+func TestLogIdCacheEviction(t *testing.T) {
+    cache := NewLogIdCache(2, time.Hour, time.Hour)
+    cache.Add(1, 101)
+    cache.Add(2, 102)
+
+    // 1 was used last, so 2 makes room for 3
+    cache.Get(1)
+    cache.Add(3, 103)
+
+    tests := []struct {
+        jobId  int
+        logId  int
+        cached bool
+    }{
+        {1, 101, true},
+        {2, 0, false},
+        {3, 103, true},
+    }
+
+    for _, test := range tests {
+        logId, found, ok := cache.Get(test.jobId)
+        if ok != test.cached || (ok && (!found || logId != test.logId)) {
+            t.Errorf("job %d: expected cached %v with log %d, got cached %v found %v log %d", test.jobId, test.cached, test.logId, ok, found, logId)
+        }
+    }
+}
+
+func TestLogIdCacheExpiry(t *testing.T) {
+    cache := NewLogIdCache(10, time.Hour, time.Minute)
+    cache.Add(1, 101)
+    cache.AddMissing(2)
+
+    // age moves the entries of all jobs closer to expiring
+    age := func(d time.Duration) {
+        for _, element := range cache.entries {
+            entry := element.Value.(*logIdCacheEntry)
+            entry.expires = entry.expires.Add(-d)
+        }
+    }
+
+    if _, _, ok := cache.Get(1); !ok {
+        t.Error("expected job 1 to be cached")
+    }
+    if _, found, ok := cache.Get(2); !ok || found {
+        t.Error("expected job 2 to be cached as missing")
+    }
+
+    age(2 * time.Minute)
+
+    if _, _, ok := cache.Get(1); !ok {
+        t.Error("expected job 1 to be cached for its TTL")
+    }
+    if _, _, ok := cache.Get(2); ok {
+        t.Error("expected the missing job 2 to expire after the negative TTL")
+    }
+
+    age(time.Hour)
+
+    if _, _, ok := cache.Get(1); ok {
+        t.Error("expected job 1 to expire after its TTL")
+    }
+}
+
+func TestCachingDBLogNotFound(t *testing.T) {
+    tests := []struct {
+        name        string
+        negativeTTL time.Duration
+        lookups     int
+    }{
+        {"not cached without a negative TTL", 0, 2},
+        {"cached for the negative TTL", time.Hour, 1},
+    }
+
+    for _, test := range tests {
+        db := &countingDB{logIds: map[int]int{}}
+        cachingDB := NewCachingDB(db, NewLogIdCache(10, time.Hour, test.negativeTTL))
+
+        for i := 0; i < 2; i++ {
+            if _, err := cachingDB.FindLogId(context.Background(), 1); err == nil {
+                t.Fatalf("%s: expected a LogNotFoundError", test.name)
+            } else if _, notFound := err.(*LogNotFoundError); !notFound {
+                t.Fatalf("%s: expected a LogNotFoundError, got %v", test.name, err)
+            }
+        }
+
+        if db.lookups != test.lookups {
+            t.Errorf("%s: expected %d lookups, got %d", test.name, test.lookups, db.lookups)
+        }
+
+        // creating the log replaces the cached miss
+        if _, _, err := cachingDB.FindOrCreateLogId(context.Background(), 1); err != nil {
+            t.Fatal(err)
+        }
+        if logId, err := cachingDB.FindLogId(context.Background(), 1); err != nil || logId != 101 {
+            t.Errorf("%s: expected log 101 once created, got %d - %v", test.name, logId, err)
+        }
+        if db.lookups != test.lookups {
+            t.Errorf("%s: expected the created log to be cached, got %d lookups", test.name, db.lookups)
+        }
+    }
+}
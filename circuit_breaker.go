@@ -0,0 +1,110 @@
+package main
+
+import (
+    "errors"
+    "sync"
+    "time"
+)
+
+const (
+    breakerClosed = iota
+    breakerHalfOpen
+    breakerOpen
+)
+
+var errCircuitOpen = errors.New("circuit breaker is open")
+
+// CircuitBreaker stops calls to a failing service. After failureThreshold
+// consecutive failures it opens and rejects calls for cooldown, then lets
+// single probe calls through while half-open: a failed probe opens it again,
+// successThreshold successful ones close it.
+type CircuitBreaker struct {
+    failureThreshold int
+    successThreshold int
+    cooldown         time.Duration
+    mu               sync.Mutex
+    state            int
+    failures         int
+    successes        int
+    openedAt         time.Time
+    probing          bool
+}
+
+func NewCircuitBreaker(failureThreshold int, successThreshold int, cooldown time.Duration) *CircuitBreaker {
+    if successThreshold < 1 {
+        successThreshold = 1
+    }
+
+    appMetrics.UpdatePusherBreakerState(breakerClosed)
+
+    return &CircuitBreaker{
+        failureThreshold: failureThreshold,
+        successThreshold: successThreshold,
+        cooldown:         cooldown,
+    }
+}
+
+// Allow returns errCircuitOpen when a call should not be made, otherwise the
+// outcome of the call has to be passed to Record.
+func (cb *CircuitBreaker) Allow() error {
+    cb.mu.Lock()
+    defer cb.mu.Unlock()
+
+    switch cb.state {
+    case breakerOpen:
+        if time.Since(cb.openedAt) < cb.cooldown {
+            return errCircuitOpen
+        }
+        cb.setState(breakerHalfOpen)
+        cb.successes = 0
+        fallthrough
+    case breakerHalfOpen:
+        if cb.probing {
+            return errCircuitOpen
+        }
+        cb.probing = true
+    }
+
+    return nil
+}
+
+func (cb *CircuitBreaker) Record(failed bool) {
+    cb.mu.Lock()
+    defer cb.mu.Unlock()
+
+    switch cb.state {
+    case breakerClosed:
+        if !failed {
+            cb.failures = 0
+            return
+        }
+
+        cb.failures++
+        if cb.failures >= cb.failureThreshold {
+            cb.open()
+        }
+    case breakerHalfOpen:
+        cb.probing = false
+
+        if failed {
+            cb.open()
+            return
+        }
+
+        cb.successes++
+        if cb.successes >= cb.successThreshold {
+            cb.failures = 0
+            cb.setState(breakerClosed)
+        }
+    }
+}
+
+func (cb *CircuitBreaker) open() {
+    cb.openedAt = time.Now()
+    cb.setState(breakerOpen)
+}
+
+func (cb *CircuitBreaker) setState(state int) {
+    cb.state = state
+    appMetrics.UpdatePusherBreakerState(state)
+}
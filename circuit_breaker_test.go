@@ -0,0 +1,54 @@
+package main
+
+import (
+    "testing"
+    "time"
+)
+
+func TestCircuitBreakerTransitions(t *testing.T) {
+    // steps are "allow" and "deny" checking Allow, "ok" and "fail" recording
+    // an outcome, and "cooldown" letting the cooldown pass
+    tests := []struct {
+        name  string
+        steps []string
+        state int
+    }{
+        {"closed below the threshold", []string{"allow", "fail", "allow", "fail"}, breakerClosed},
+        {"open after the threshold", []string{"allow", "fail", "allow", "fail", "allow", "fail", "deny"}, breakerOpen},
+        {"failures reset by a success", []string{"fail", "fail", "ok", "fail", "fail", "allow"}, breakerClosed},
+        {"open during the cooldown", []string{"fail", "fail", "fail", "deny", "deny"}, breakerOpen},
+        {"half-open after the cooldown", []string{"fail", "fail", "fail", "cooldown", "allow"}, breakerHalfOpen},
+        {"a single probe while half-open", []string{"fail", "fail", "fail", "cooldown", "allow", "deny"}, breakerHalfOpen},
+        {"open again after a failed probe", []string{"fail", "fail", "fail", "cooldown", "allow", "fail", "deny"}, breakerOpen},
+        {"half-open until enough probes succeed", []string{"fail", "fail", "fail", "cooldown", "allow", "ok", "allow"}, breakerHalfOpen},
+        {"closed after successful probes", []string{"fail", "fail", "fail", "cooldown", "allow", "ok", "allow", "ok", "allow", "allow"}, breakerClosed},
+        {"failures counted from zero once closed", []string{"fail", "fail", "fail", "cooldown", "allow", "ok", "allow", "ok", "fail", "fail", "allow"}, breakerClosed},
+    }
+
+    for _, test := range tests {
+        cb := NewCircuitBreaker(3, 2, time.Hour)
+
+        for i, step := range test.steps {
+            switch step {
+            case "allow":
+                if err := cb.Allow(); err != nil {
+                    t.Errorf("%s: step %d expected the call to be allowed, got %v", test.name, i+1, err)
+                }
+            case "deny":
+                if err := cb.Allow(); err != errCircuitOpen {
+                    t.Errorf("%s: step %d expected errCircuitOpen, got %v", test.name, i+1, err)
+                }
+            case "ok":
+                cb.Record(false)
+            case "fail":
+                cb.Record(true)
+            case "cooldown":
+                cb.openedAt = cb.openedAt.Add(-cb.cooldown)
+            }
+        }
+
+        if cb.state != test.state {
+            t.Errorf("%s: expected state %d, got %d", test.name, test.state, cb.state)
+        }
+    }
+}
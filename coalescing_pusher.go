@@ -0,0 +1,196 @@
+package main
+
+import (
+    "context"
+    "log"
+    "sort"
+    "sync"
+    "time"
+)
+
+type payloadPublisher interface {
+    PublishPayload(context.Context, PusherPayload) error
+}
+
+// CoalescingPusher merges the log parts of a job published within window
+// into a single job:log event, saving Pusher calls for chatty jobs. A final
+// log part is published right away together with the parts pending for its
+// job.
+//
+// Publish returns before the merged event is published, so the log parts
+// are not requeued when Pusher fails. Failures of the background publishes
+// are only logged and counted. The events of a job are published one after
+// the other, in order.
+type CoalescingPusher struct {
+    publisher payloadPublisher
+    window    time.Duration
+    timeout   time.Duration
+    mu        sync.Mutex
+    pending   map[int]*coalescedParts
+    flushing  map[int]chan struct{}
+}
+
+type coalescedParts struct {
+    payloads []PusherPayload
+    timer    *time.Timer
+}
+
+// NewCoalescingPusher returns a CoalescingPusher publishing to publisher,
+// timeout bounds the publishes made once a window is over.
+func NewCoalescingPusher(publisher payloadPublisher, window time.Duration, timeout time.Duration) *CoalescingPusher {
+    return &CoalescingPusher{
+        publisher: publisher,
+        window:    window,
+        timeout:   timeout,
+        pending:   map[int]*coalescedParts{},
+        flushing:  map[int]chan struct{}{},
+    }
+}
+
+func (cp *CoalescingPusher) Publish(ctx context.Context, jobId int, number int, content string, final bool) error {
+    payload := PusherPayload{
+        JobId:   jobId,
+        Number:  number,
+        Content: content,
+        Final:   final,
+    }
+
+    cp.mu.Lock()
+
+    pending := cp.pending[jobId]
+    if pending == nil {
+        pending = &coalescedParts{}
+        cp.pending[jobId] = pending
+    }
+    pending.payloads = append(pending.payloads, payload)
+
+    if !final {
+        if pending.timer == nil {
+            pending.timer = time.AfterFunc(cp.window, func() {
+                cp.flushWindow(jobId, pending)
+            })
+        }
+        cp.mu.Unlock()
+        return nil
+    }
+
+    delete(cp.pending, jobId)
+    if pending.timer != nil {
+        pending.timer.Stop()
+    }
+
+    previous, done := cp.startFlush(jobId)
+    cp.mu.Unlock()
+
+    defer cp.finishFlush(jobId, done)
+
+    if previous != nil {
+        select {
+        case <-previous:
+        case <-ctx.Done():
+            return &PusherPublishError{ctx.Err(), false}
+        }
+    }
+
+    return cp.publish(ctx, pending.payloads)
+}
+
+// Close publishes the log parts still pending.
+func (cp *CoalescingPusher) Close() {
+    cp.mu.Lock()
+    pending := cp.pending
+    cp.pending = map[int]*coalescedParts{}
+    cp.mu.Unlock()
+
+    for jobId, parts := range pending {
+        parts.timer.Stop()
+        cp.flush(jobId, parts)
+    }
+}
+
+func (cp *CoalescingPusher) flushWindow(jobId int, parts *coalescedParts) {
+    cp.mu.Lock()
+    if cp.pending[jobId] != parts {
+        // already published along with a final log part
+        cp.mu.Unlock()
+        return
+    }
+    delete(cp.pending, jobId)
+    cp.mu.Unlock()
+
+    cp.flush(jobId, parts)
+}
+
+// startFlush registers a publish of the job's log parts, returning the
+// publish it has to wait for, if any, and the channel to close once done.
+// It is called with mu held.
+func (cp *CoalescingPusher) startFlush(jobId int) (chan struct{}, chan struct{}) {
+    previous := cp.flushing[jobId]
+    done := make(chan struct{})
+    cp.flushing[jobId] = done
+
+    return previous, done
+}
+
+func (cp *CoalescingPusher) finishFlush(jobId int, done chan struct{}) {
+    cp.mu.Lock()
+    if cp.flushing[jobId] == done {
+        delete(cp.flushing, jobId)
+    }
+    cp.mu.Unlock()
+
+    close(done)
+}
+
+// flush publishes the log parts of a window once the job's earlier events
+// are published.
+func (cp *CoalescingPusher) flush(jobId int, parts *coalescedParts) {
+    cp.mu.Lock()
+    previous, done := cp.startFlush(jobId)
+    cp.mu.Unlock()
+
+    defer cp.finishFlush(jobId, done)
+
+    if previous != nil {
+        <-previous
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), cp.timeout)
+    defer cancel()
+
+    if err := cp.publish(ctx, parts.payloads); countPusherError(err) {
+        log.Printf("flush: error publishing log parts of job %d - %v", jobId, err)
+    }
+}
+
+func (cp *CoalescingPusher) publish(ctx context.Context, payloads []PusherPayload) error {
+    if len(payloads) == 1 {
+        return cp.publisher.PublishPayload(ctx, payloads[0])
+    }
+
+    appMetrics.MarkCoalescedPusherEventCount(len(payloads))
+
+    return cp.publisher.PublishPayload(ctx, mergePusherPayloads(payloads))
+}
+
+// mergePusherPayloads joins the log parts of a job in number order.
+func mergePusherPayloads(payloads []PusherPayload) PusherPayload {
+    sort.SliceStable(payloads, func(i, j int) bool {
+        return payloads[i].Number < payloads[j].Number
+    })
+
+    merged := PusherPayload{
+        JobId:  payloads[0].JobId,
+        Number: payloads[0].Number,
+    }
+
+    content := make([]byte, 0, len(payloads)*len(payloads[0].Content))
+    for _, payload := range payloads {
+        merged.Numbers = append(merged.Numbers, payload.Number)
+        merged.Final = merged.Final || payload.Final
+        content = append(content, payload.Content...)
+    }
+    merged.Content = string(content)
+
+    return merged
+}
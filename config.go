@@ -0,0 +1,132 @@
+package main
+
+import (
+    "encoding/json"
+    "flag"
+    "fmt"
+    "os"
+    "strconv"
+)
+
+// ConsumerConfig is how log parts are consumed from RabbitMQ. Every setting
+// comes from, in order of precedence, its flag when given, its environment
+// variable, the JSON config file named by -config or $LOGS_CONFIG_FILE, and
+// the default of its flag.
+type ConsumerConfig struct {
+    QueueName string `json:"queue"`
+
+    // Subscriptions is how many AMQP consumers are opened on the queue,
+    // each processing Consumers log parts concurrently with up to Prefetch
+    // unacked ones.
+    Subscriptions int `json:"subscriptions"`
+    Consumers     int `json:"consumers"`
+    Prefetch      int `json:"prefetch"`
+}
+
+// consumerSettings maps the flags of the settings to their environment
+// variables and fields.
+var consumerSettings = []struct {
+    flag  string
+    env   string
+    field func(*ConsumerConfig) interface{}
+}{
+    {"queue", "LOGS_QUEUE", func(c *ConsumerConfig) interface{} { return &c.QueueName }},
+    {"subscriptions", "LOGS_SUBSCRIPTIONS", func(c *ConsumerConfig) interface{} { return &c.Subscriptions }},
+    {"consumers", "LOGS_CONSUMERS", func(c *ConsumerConfig) interface{} { return &c.Consumers }},
+    {"prefetch", "LOGS_PREFETCH", func(c *ConsumerConfig) interface{} { return &c.Prefetch }},
+}
+
+func loadConsumerConfig() (ConsumerConfig, error) {
+    config := ConsumerConfig{
+        QueueName:     *queueName,
+        Subscriptions: *subscriptions,
+        Consumers:     *consumers,
+        Prefetch:      *prefetch,
+    }
+
+    path := *configFile
+    if path == "" {
+        path = os.Getenv("LOGS_CONFIG_FILE")
+    }
+
+    if path != "" {
+        if err := readConfigFile(path, &config); err != nil {
+            return config, err
+        }
+    }
+
+    given := map[string]bool{}
+    flag.Visit(func(f *flag.Flag) {
+        given[f.Name] = true
+    })
+
+    for _, setting := range consumerSettings {
+        var value string
+        if given[setting.flag] {
+            value = flag.Lookup(setting.flag).Value.String()
+        } else if env := os.Getenv(setting.env); env != "" {
+            value = env
+        } else {
+            continue
+        }
+
+        var err error
+        switch field := setting.field(&config).(type) {
+        case *string:
+            *field = value
+        case *int:
+            *field, err = strconv.Atoi(value)
+        }
+
+        if err != nil {
+            return config, fmt.Errorf("loadConsumerConfig: invalid %s %q: %v", setting.flag, value, err)
+        }
+    }
+
+    if config.Prefetch == 0 {
+        config.Prefetch = config.Consumers * 3
+    }
+
+    return config, config.Validate()
+}
+
+func readConfigFile(path string, config *ConsumerConfig) error {
+    file, err := os.Open(path)
+    if err != nil {
+        return fmt.Errorf("readConfigFile: %v", err)
+    }
+    defer file.Close()
+
+    decoder := json.NewDecoder(file)
+    decoder.DisallowUnknownFields()
+
+    if err = decoder.Decode(config); err != nil {
+        return fmt.Errorf("readConfigFile: error parsing %s: %v", path, err)
+    }
+
+    return nil
+}
+
+func (c ConsumerConfig) Validate() error {
+    if c.QueueName == "" {
+        return fmt.Errorf("the queue name is empty")
+    }
+
+    if c.Subscriptions < 1 {
+        return fmt.Errorf("at least one subscription is needed, got %d", c.Subscriptions)
+    }
+
+    if c.Consumers < 1 {
+        return fmt.Errorf("at least one consumer per subscription is needed, got %d", c.Consumers)
+    }
+
+    if c.Prefetch < c.Consumers {
+        return fmt.Errorf("a prefetch of %d leaves some of the %d consumers idle", c.Prefetch, c.Consumers)
+    }
+
+    return nil
+}
+
+func (c ConsumerConfig) String() string {
+    return fmt.Sprintf("queue=%s subscriptions=%d consumers=%d prefetch=%d", c.QueueName, c.Subscriptions, c.Consumers, c.Prefetch)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+    "flag"
+    "io/ioutil"
+    "os"
+    "testing"
+)
+
+// loadTestConsumerConfig loads the consumer config with the given command
+// line, environment and config file, restoring the globals afterwards.
+func loadTestConsumerConfig(t *testing.T, args []string, env map[string]string, file string) ConsumerConfig {
+    commandLine := flag.CommandLine
+    defer func() { flag.CommandLine = commandLine }()
+
+    // a fresh flag set, so that the flags given don't stick to later loads
+    flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+    flag.String("queue", *queueName, "")
+    flag.Int("subscriptions", *subscriptions, "")
+    flag.Int("consumers", *consumers, "")
+    flag.Int("prefetch", *prefetch, "")
+    if err := flag.CommandLine.Parse(args); err != nil {
+        t.Fatal(err)
+    }
+
+    for _, setting := range consumerSettings {
+        defer os.Setenv(setting.env, os.Getenv(setting.env))
+        os.Unsetenv(setting.env)
+    }
+    for name, value := range env {
+        os.Setenv(name, value)
+    }
+
+    path := *configFile
+    defer func() { *configFile = path }()
+    *configFile = ""
+
+    if file != "" {
+        f, err := ioutil.TempFile("", "consumer-config")
+        if err != nil {
+            t.Fatal(err)
+        }
+        defer os.Remove(f.Name())
+
+        if _, err = f.WriteString(file); err != nil {
+            t.Fatal(err)
+        }
+        f.Close()
+
+        *configFile = f.Name()
+    }
+
+    config, err := loadConsumerConfig()
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    return config
+}
+
+func TestLoadConsumerConfigPrecedence(t *testing.T) {
+    tests := []struct {
+        name      string
+        args      []string
+        env       map[string]string
+        file      string
+        queue     string
+        consumers int
+        prefetch  int
+    }{
+        {
+            name:      "defaults",
+            queue:     "reporting.jobs.logs",
+            consumers: 30,
+            prefetch:  90,
+        },
+        {
+            name:      "file over defaults",
+            file:      `{"queue": "file", "consumers": 5, "prefetch": 12}`,
+            queue:     "file",
+            consumers: 5,
+            prefetch:  12,
+        },
+        {
+            name:      "env over file",
+            env:       map[string]string{"LOGS_QUEUE": "env", "LOGS_CONSUMERS": "6"},
+            file:      `{"queue": "file", "consumers": 5}`,
+            queue:     "env",
+            consumers: 6,
+            prefetch:  18,
+        },
+        {
+            name:      "flags over env",
+            args:      []string{"-queue", "flag", "-consumers", "7"},
+            env:       map[string]string{"LOGS_QUEUE": "env", "LOGS_CONSUMERS": "6"},
+            file:      `{"queue": "file", "consumers": 5}`,
+            queue:     "flag",
+            consumers: 7,
+            prefetch:  21,
+        },
+        {
+            name:      "flags given with their default",
+            args:      []string{"-consumers", "30"},
+            env:       map[string]string{"LOGS_CONSUMERS": "6"},
+            queue:     "reporting.jobs.logs",
+            consumers: 30,
+            prefetch:  90,
+        },
+        {
+            name:      "each setting from its own layer",
+            args:      []string{"-prefetch", "40"},
+            env:       map[string]string{"LOGS_CONSUMERS": "8"},
+            file:      `{"queue": "file"}`,
+            queue:     "file",
+            consumers: 8,
+            prefetch:  40,
+        },
+    }
+
+    for _, test := range tests {
+        config := loadTestConsumerConfig(t, test.args, test.env, test.file)
+
+        if config.QueueName != test.queue || config.Consumers != test.consumers || config.Prefetch != test.prefetch {
+            t.Errorf("%s: expected queue=%s consumers=%d prefetch=%d, got %v", test.name, test.queue, test.consumers, test.prefetch, config)
+        }
+    }
+}
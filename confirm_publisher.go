@@ -0,0 +1,120 @@
+package main
+
+import (
+    "errors"
+    "github.com/streadway/amqp"
+    "sync"
+    "time"
+)
+
+// confirmTimeout is how long a publish waits for the broker to confirm it.
+const confirmTimeout = 10 * time.Second
+
+var (
+    errPublishNacked      = errors.New("publish was nacked by the broker")
+    errPublishUnconfirmed = errors.New("publish was not confirmed by the broker")
+)
+
+// confirmPublisher publishes on a channel in confirm mode, and only returns
+// once the broker has taken responsibility for the message. Messages are
+// acked after their retried or dead lettered copy was published, so without
+// the confirm a broker failure in between would lose them.
+//
+// Publishes are serialized, they only happen for failing messages. A
+// channel closed by the broker is opened again on the next publish.
+type confirmPublisher struct {
+    mu    sync.Mutex
+    conn  *amqp.Connection
+    ch    *amqp.Channel
+    acks  chan uint64
+    nacks chan uint64
+    tag   uint64
+}
+
+func newConfirmPublisher(conn *amqp.Connection) (*confirmPublisher, error) {
+    p := &confirmPublisher{conn: conn}
+    if err := p.open(); err != nil {
+        return nil, err
+    }
+
+    return p, nil
+}
+
+func (p *confirmPublisher) open() error {
+    ch, err := p.conn.Channel()
+    if err != nil {
+        return err
+    }
+
+    if err = ch.Confirm(false); err != nil {
+        ch.Close()
+        return err
+    }
+
+    // confirms of publishes which timed out still arrive later, the buffer
+    // keeps them from blocking the connection until the next publish
+    // discards them
+    p.acks, p.nacks = ch.NotifyConfirm(make(chan uint64, 64), make(chan uint64, 64))
+    p.ch = ch
+    p.tag = 0
+
+    return nil
+}
+
+// Publish publishes msg and waits for the broker to confirm it.
+func (p *confirmPublisher) Publish(exchange string, key string, msg amqp.Publishing) error {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+
+    if p.ch == nil {
+        if err := p.open(); err != nil {
+            return err
+        }
+    }
+
+    if err := p.ch.Publish(exchange, key, false, false, msg); err != nil {
+        p.reset()
+        return err
+    }
+    p.tag++
+
+    timeout := time.After(confirmTimeout)
+    for {
+        select {
+        case tag, ok := <-p.acks:
+            if !ok {
+                p.reset()
+                return errPublishUnconfirmed
+            }
+            if tag == p.tag {
+                return nil
+            }
+        case tag, ok := <-p.nacks:
+            if !ok {
+                p.reset()
+                return errPublishUnconfirmed
+            }
+            if tag == p.tag {
+                return errPublishNacked
+            }
+        case <-timeout:
+            return errPublishUnconfirmed
+        }
+    }
+}
+
+// reset drops the channel after it failed, so the next publish opens a new
+// one.
+func (p *confirmPublisher) reset() {
+    p.ch.Close()
+    p.ch = nil
+}
+
+func (p *confirmPublisher) Close() {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+
+    if p.ch != nil {
+        p.ch.Close()
+    }
+}
@@ -1,57 +1,370 @@
 package main
 
 import (
+    "context"
     "database/sql"
     "fmt"
     "github.com/lib/pq"
     "time"
 )
 
+type Log struct {
+    Id           int
+    JobId        int
+    Content      string
+    AggregatedAt *time.Time
+}
+
+type LogPart struct {
+    LogId   int
+    Number  int
+    Content string
+    Final   bool
+}
+
+// PoolConfig sizes the connection pool behind a RealDB, which is shared by
+// all goroutines using it.
+type PoolConfig struct {
+    MaxOpenConns    int
+    MaxIdleConns    int
+    ConnMaxLifetime time.Duration
+}
+
 type DB interface {
-    FindLogId(int) (int, error)
-    CreateLogPart(int, int, string, bool) error
+    FindLogId(context.Context, int) (int, error)
+    FindOrCreateLogId(context.Context, int) (int, bool, error)
+    CreateLogPart(context.Context, int, int, string, bool) (bool, error)
+    CreateLogParts(context.Context, []LogPart) ([]bool, error)
+    FindLogWithParts(context.Context, int, int) (*Log, []LogPart, error)
+    FindAggregatableLogIds(context.Context, int, []int, time.Time) ([]int, error)
+    AggregateLog(context.Context, int) error
+    Stats() sql.DBStats
     Close()
 }
 
 type RealDB struct {
-    conn          *sql.DB
-    jobIdFind     *sql.Stmt
-    logPartCreate *sql.Stmt
+    conn             *sql.DB
+    jobIdFind        *sql.Stmt
+    logFind          *sql.Stmt
+    logPartsFind     *sql.Stmt
+    logCreate        *sql.Stmt
+    logPartCreate    *sql.Stmt
+    aggregatableFind *sql.Stmt
+    logLock          *sql.Stmt
+    logPartsMaxId    *sql.Stmt
+    logAggregate     *sql.Stmt
+    logPartsMark     *sql.Stmt
+    logPartsGone     *sql.Stmt
 }
 
-func (db *RealDB) FindLogId(jobId int) (int, error) {
+func (db *RealDB) FindLogId(ctx context.Context, jobId int) (int, error) {
     var logId int
-    err := db.jobIdFind.QueryRow(jobId).Scan(&logId)
+    err := db.jobIdFind.QueryRowContext(ctx, jobId).Scan(&logId)
 
     switch {
     case err == sql.ErrNoRows:
-        return 0, fmt.Errorf("FindLogId: no log with job_id:%s found", jobId)
+        return 0, &LogNotFoundError{jobId}
     case err != nil:
-        return 0, fmt.Errorf("FindLogId: db query failed: %v", err)
+        return 0, &DBError{"FindLogId", err}
     }
 
     return logId, nil
 }
 
-func (db *RealDB) CreateLogPart(logId int, number int, content string, final bool) error {
+// FindOrCreateLogId returns the id of the log for a job, creating the log if
+// there is none yet, and whether it was created. logs.job_id is unique, so
+// whoever creates the log first wins and everyone else finds it.
+func (db *RealDB) FindOrCreateLogId(ctx context.Context, jobId int) (int, bool, error) {
+    var logId int
+    err := db.logCreate.QueryRowContext(ctx, jobId, time.Now()).Scan(&logId)
+
+    switch {
+    case err == nil:
+        return logId, true, nil
+    case err != sql.ErrNoRows:
+        return 0, false, &DBError{"FindOrCreateLogId", err}
+    }
+
+    if err = db.jobIdFind.QueryRowContext(ctx, jobId).Scan(&logId); err != nil {
+        return 0, false, &DBError{"FindOrCreateLogId", err}
+    }
+
+    return logId, false, nil
+}
+
+// CreateLogPart stores a log part and reports whether it was new. Parts are
+// unique on (log_id, number), a redelivered part is not stored twice.
+func (db *RealDB) CreateLogPart(ctx context.Context, logId int, number int, content string, final bool) (bool, error) {
     var logPartId int
-    err := db.logPartCreate.QueryRow(logId, number, content, final, time.Now()).Scan(&logPartId)
+    err := db.logPartCreate.QueryRowContext(ctx, logId, number, content, final, time.Now()).Scan(&logPartId)
+
+    switch {
+    case err == sql.ErrNoRows:
+        return false, nil
+    case err != nil:
+        return false, &DBError{"CreateLogPart", err}
+    }
+
+    return true, nil
+}
+
+// CreateLogParts writes log parts with a single COPY in one transaction and
+// reports for each part whether it was new. The parts are copied into a
+// temporary table first, as COPY itself can't skip existing parts. The table
+// is created once per connection and emptied on commit.
+func (db *RealDB) CreateLogParts(ctx context.Context, parts []LogPart) ([]bool, error) {
+    tx, err := db.conn.BeginTx(ctx, nil)
+    if err != nil {
+        return nil, &DBError{"CreateLogParts", err}
+    }
+
+    if _, err = tx.ExecContext(ctx, "CREATE TEMPORARY TABLE IF NOT EXISTS log_parts_batch (log_id integer, number integer, content text, final boolean, created_at timestamp) ON COMMIT DELETE ROWS"); err != nil {
+        tx.Rollback()
+        return nil, &DBError{"CreateLogParts", err}
+    }
+
+    stmt, err := tx.PrepareContext(ctx, pq.CopyIn("log_parts_batch", "log_id", "number", "content", "final", "created_at"))
+    if err != nil {
+        tx.Rollback()
+        return nil, &DBError{"CreateLogParts", err}
+    }
+
+    now := time.Now()
+    for _, part := range parts {
+        if _, err = stmt.ExecContext(ctx, part.LogId, part.Number, part.Content, part.Final, now); err != nil {
+            stmt.Close()
+            tx.Rollback()
+            return nil, &DBError{"CreateLogParts", err}
+        }
+    }
+
+    if _, err = stmt.ExecContext(ctx); err != nil {
+        stmt.Close()
+        tx.Rollback()
+        return nil, &DBError{"CreateLogParts", err}
+    }
+
+    if err = stmt.Close(); err != nil {
+        tx.Rollback()
+        return nil, &DBError{"CreateLogParts", err}
+    }
+
+    rows, err := tx.QueryContext(ctx, "INSERT INTO log_parts (log_id, number, content, final, created_at) SELECT log_id, number, content, final, created_at FROM log_parts_batch ON CONFLICT (log_id, number) DO NOTHING RETURNING log_id, number")
+    if err != nil {
+        tx.Rollback()
+        return nil, &DBError{"CreateLogParts", err}
+    }
+
+    inserted := map[LogPart]int{}
+    for rows.Next() {
+        var key LogPart
+        if err = rows.Scan(&key.LogId, &key.Number); err != nil {
+            rows.Close()
+            tx.Rollback()
+            return nil, &DBError{"CreateLogParts", err}
+        }
+        inserted[key]++
+    }
+    rows.Close()
+
+    if err = rows.Err(); err != nil {
+        tx.Rollback()
+        return nil, &DBError{"CreateLogParts", err}
+    }
+
+    if err = tx.Commit(); err != nil {
+        return nil, &DBError{"CreateLogParts", err}
+    }
+
+    // a part which is in the batch twice was only inserted once
+    created := make([]bool, len(parts))
+    for i, part := range parts {
+        key := LogPart{LogId: part.LogId, Number: part.Number}
+        if inserted[key] > 0 {
+            created[i] = true
+            inserted[key]--
+        }
+    }
+
+    return created, nil
+}
+
+// FindLogWithParts returns the log of a job along with its not yet aggregated
+// parts with a number greater than after, ordered by number. Both are read in
+// one transaction, so that an aggregation running meanwhile doesn't make
+// parts go missing from the result. A LogPartsAggregatedError is returned
+// when some of the parts after the given number only remain in the
+// aggregated content.
+func (db *RealDB) FindLogWithParts(ctx context.Context, jobId int, after int) (*Log, []LogPart, error) {
+    tx, err := db.conn.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+    if err != nil {
+        return nil, nil, &DBError{"FindLogWithParts", err}
+    }
+    defer tx.Rollback()
+
+    l, err := db.findLog(ctx, tx, jobId)
+    if err != nil {
+        return nil, nil, err
+    }
+
+    if after >= 0 && l.AggregatedAt != nil {
+        var gone bool
+        if err = tx.StmtContext(ctx, db.logPartsGone).QueryRowContext(ctx, l.Id, after).Scan(&gone); err != nil {
+            return nil, nil, &DBError{"FindLogWithParts", err}
+        }
+        if gone {
+            return nil, nil, &LogPartsAggregatedError{jobId, after}
+        }
+    }
+
+    parts, err := db.findLogParts(ctx, tx, l.Id, after)
+    if err != nil {
+        return nil, nil, err
+    }
+
+    return l, parts, nil
+}
+
+func (db *RealDB) findLog(ctx context.Context, tx *sql.Tx, jobId int) (*Log, error) {
+    l := &Log{JobId: jobId}
+    var content sql.NullString
+    var aggregatedAt pq.NullTime
+
+    err := tx.StmtContext(ctx, db.logFind).QueryRowContext(ctx, jobId).Scan(&l.Id, &content, &aggregatedAt)
 
     switch {
     case err == sql.ErrNoRows:
-        return fmt.Errorf("CreateLogPart: log part number:%s for logId:%s could not be created. (%v)", number, logId, err)
+        return nil, &LogNotFoundError{jobId}
     case err != nil:
-        return fmt.Errorf("CreateLogPart: db query failed: %v", err)
+        return nil, &DBError{"FindLog", err}
+    }
+
+    l.Content = content.String
+    if aggregatedAt.Valid {
+        l.AggregatedAt = &aggregatedAt.Time
+    }
+
+    return l, nil
+}
+
+func (db *RealDB) findLogParts(ctx context.Context, tx *sql.Tx, logId int, after int) ([]LogPart, error) {
+    rows, err := tx.StmtContext(ctx, db.logPartsFind).QueryContext(ctx, logId, after)
+    if err != nil {
+        return nil, &DBError{"FindLogParts", err}
+    }
+    defer rows.Close()
+
+    parts := []LogPart{}
+    for rows.Next() {
+        part := LogPart{LogId: logId}
+        var content sql.NullString
+        var final sql.NullBool
+        if err = rows.Scan(&part.Number, &content, &final); err != nil {
+            return nil, &DBError{"FindLogParts", err}
+        }
+        part.Content = content.String
+        part.Final = final.Bool
+        parts = append(parts, part)
+    }
+
+    if err = rows.Err(); err != nil {
+        return nil, &DBError{"FindLogParts", err}
+    }
+
+    return parts, nil
+}
+
+// FindAggregatableLogIds returns up to limit logs, other than the excluded
+// ones, with parts to aggregate: logs which received their final part, and
+// logs receiving parts after they were aggregated. Only parts created before
+// the given time count, so parts still arriving out of order get a grace
+// period to catch up. Logs waiting the longest come first.
+func (db *RealDB) FindAggregatableLogIds(ctx context.Context, limit int, exclude []int, before time.Time) ([]int, error) {
+    excludeIds := make([]int64, len(exclude))
+    for i, logId := range exclude {
+        excludeIds[i] = int64(logId)
+    }
+
+    rows, err := db.aggregatableFind.QueryContext(ctx, limit, pq.Array(excludeIds), before)
+    if err != nil {
+        return nil, fmt.Errorf("FindAggregatableLogIds: db query failed: %v", err)
+    }
+    defer rows.Close()
+
+    logIds := []int{}
+    for rows.Next() {
+        var logId int
+        if err = rows.Scan(&logId); err != nil {
+            return nil, fmt.Errorf("FindAggregatableLogIds: scanning row failed: %v", err)
+        }
+        logIds = append(logIds, logId)
+    }
+
+    if err = rows.Err(); err != nil {
+        return nil, fmt.Errorf("FindAggregatableLogIds: db query failed: %v", err)
+    }
+
+    return logIds, nil
+}
+
+// AggregateLog appends the log parts of a log to logs.content, ordered by
+// number, and marks the parts as aggregated. The parts are kept, so that a
+// redelivered part conflicts instead of being aggregated again, and so that
+// a part arriving after the aggregation with a lower number than the parts
+// already aggregated rebuilds the content in number order instead of being
+// appended. Only parts which existed when the aggregation started are
+// touched, so parts arriving mid-aggregation are left for the next run.
+func (db *RealDB) AggregateLog(ctx context.Context, logId int) error {
+    tx, err := db.conn.BeginTx(ctx, nil)
+    if err != nil {
+        return fmt.Errorf("AggregateLog: could not start transaction: %v", err)
+    }
+
+    // the row lock on logs serializes concurrent aggregators for the same log
+    var lockedId int
+    if err = tx.StmtContext(ctx, db.logLock).QueryRowContext(ctx, logId).Scan(&lockedId); err != nil {
+        tx.Rollback()
+        return fmt.Errorf("AggregateLog: locking logId:%d failed: %v", logId, err)
+    }
+
+    var maxId sql.NullInt64
+    if err = tx.StmtContext(ctx, db.logPartsMaxId).QueryRowContext(ctx, logId).Scan(&maxId); err != nil {
+        tx.Rollback()
+        return fmt.Errorf("AggregateLog: finding log parts for logId:%d failed: %v", logId, err)
+    }
+
+    if !maxId.Valid {
+        tx.Rollback()
+        return nil
+    }
+
+    if _, err = tx.StmtContext(ctx, db.logAggregate).ExecContext(ctx, logId, maxId.Int64, time.Now()); err != nil {
+        tx.Rollback()
+        return fmt.Errorf("AggregateLog: updating content for logId:%d failed: %v", logId, err)
+    }
+
+    if _, err = tx.StmtContext(ctx, db.logPartsMark).ExecContext(ctx, logId, maxId.Int64, time.Now()); err != nil {
+        tx.Rollback()
+        return fmt.Errorf("AggregateLog: marking log parts for logId:%d failed: %v", logId, err)
+    }
+
+    if err = tx.Commit(); err != nil {
+        return fmt.Errorf("AggregateLog: commit for logId:%d failed: %v", logId, err)
     }
 
     return nil
 }
 
+func (db *RealDB) Stats() sql.DBStats {
+    return db.conn.Stats()
+}
+
 func (db *RealDB) Close() {
     db.conn.Close()
 }
 
-func NewRealDB(url string) (DB, error) {
+// openDatabase opens and checks a connection pool for a postgres url.
+func openDatabase(url string, pool PoolConfig) (*sql.DB, error) {
     pgUrl, err := pq.ParseURL(url)
     if err != nil {
         return nil, err
@@ -62,7 +375,26 @@ func NewRealDB(url string) (DB, error) {
         return nil, err
     }
 
+    db.SetMaxOpenConns(pool.MaxOpenConns)
+    db.SetMaxIdleConns(pool.MaxIdleConns)
+    db.SetConnMaxLifetime(pool.ConnMaxLifetime)
+
     if err = db.Ping(); err != nil {
+        db.Close()
+        return nil, err
+    }
+
+    return db, nil
+}
+
+func NewRealDB(url string, pool PoolConfig) (DB, error) {
+    db, err := openDatabase(url, pool)
+    if err != nil {
+        return nil, err
+    }
+
+    if err = checkMigrations(context.Background(), db); err != nil {
+        db.Close()
         return nil, err
     }
 
@@ -71,10 +403,57 @@ func NewRealDB(url string) (DB, error) {
         return nil, err
     }
 
-    logPartsCreate, err := db.Prepare("INSERT INTO log_parts (log_id, number, content, final, created_at) VALUES ($1, $2, $3, $4, $5) RETURNING id")
+    logFind, err := db.Prepare("SELECT id, content, aggregated_at FROM logs WHERE job_id=$1 ORDER BY id LIMIT 1")
+    if err != nil {
+        return nil, err
+    }
+
+    logPartsFind, err := db.Prepare("SELECT number, content, final FROM log_parts WHERE log_id=$1 AND number > $2 AND aggregated_at IS NULL ORDER BY number, id")
+    if err != nil {
+        return nil, err
+    }
+
+    logCreate, err := db.Prepare("INSERT INTO logs (job_id, created_at, updated_at) VALUES ($1, $2, $2) ON CONFLICT (job_id) DO NOTHING RETURNING id")
+    if err != nil {
+        return nil, err
+    }
+
+    logPartsCreate, err := db.Prepare("INSERT INTO log_parts (log_id, number, content, final, created_at) VALUES ($1, $2, $3, $4, $5) ON CONFLICT (log_id, number) DO NOTHING RETURNING id")
+    if err != nil {
+        return nil, err
+    }
+
+    aggregatableFind, err := db.Prepare("SELECT log_parts.log_id FROM log_parts JOIN logs ON logs.id = log_parts.log_id WHERE log_parts.aggregated_at IS NULL AND (log_parts.final = true OR logs.aggregated_at IS NOT NULL) AND NOT log_parts.log_id = ANY($2::integer[]) GROUP BY log_parts.log_id HAVING MAX(log_parts.created_at) < $3 ORDER BY MIN(log_parts.id) LIMIT $1")
+    if err != nil {
+        return nil, err
+    }
+
+    logLock, err := db.Prepare("SELECT id FROM logs WHERE id=$1 FOR UPDATE")
+    if err != nil {
+        return nil, err
+    }
+
+    logPartsMaxId, err := db.Prepare("SELECT MAX(id) FROM log_parts WHERE log_id=$1 AND aggregated_at IS NULL")
+    if err != nil {
+        return nil, err
+    }
+
+    // parts numbered below an aggregated one rebuild the content from all
+    // parts, the others are appended to it
+    logAggregate, err := db.Prepare("UPDATE logs SET content = CASE WHEN EXISTS (SELECT 1 FROM log_parts WHERE log_id=$1 AND aggregated_at IS NOT NULL AND number > (SELECT MIN(number) FROM log_parts WHERE log_id=$1 AND id <= $2 AND aggregated_at IS NULL)) THEN (SELECT string_agg(content, '' ORDER BY number, id) FROM log_parts WHERE log_id=$1 AND (id <= $2 OR aggregated_at IS NOT NULL)) ELSE COALESCE(content, '') || (SELECT string_agg(content, '' ORDER BY number, id) FROM log_parts WHERE log_id=$1 AND id <= $2 AND aggregated_at IS NULL) END, aggregated_at = $3, updated_at = $3 WHERE id=$1")
+    if err != nil {
+        return nil, err
+    }
+
+    logPartsMark, err := db.Prepare("UPDATE log_parts SET aggregated_at = $3 WHERE log_id=$1 AND id <= $2 AND aggregated_at IS NULL")
+    if err != nil {
+        return nil, err
+    }
+
+    logPartsGone, err := db.Prepare("SELECT EXISTS (SELECT 1 FROM log_parts WHERE log_id=$1 AND number > $2 AND aggregated_at IS NOT NULL)")
     if err != nil {
         return nil, err
     }
 
-    return &RealDB{db, jobIdFind, logPartsCreate}, nil
+    return &RealDB{db, jobIdFind, logFind, logPartsFind, logCreate, logPartsCreate, aggregatableFind, logLock, logPartsMaxId, logAggregate, logPartsMark, logPartsGone}, nil
 }
@@ -0,0 +1,170 @@
+package main
+
+import (
+    "context"
+    "database/sql/driver"
+    "fmt"
+    "github.com/lib/pq"
+    "io"
+    "net"
+)
+
+// ParseError is returned when a log part message body can not be decoded.
+type ParseError struct {
+    Err error
+}
+
+func (e *ParseError) Error() string {
+    return fmt.Sprintf("parseMessageBody: error during json.unmarshal: %v", e.Err)
+}
+
+// FindLogIdError is returned when the log for a job could not be looked up.
+type FindLogIdError struct {
+    JobId int
+    Err   error
+}
+
+func (e *FindLogIdError) Error() string {
+    return fmt.Sprintf("findLogId: job_id:%d - %v", e.JobId, e.Err)
+}
+
+// CreateLogPartError is returned when a log part could not be stored.
+type CreateLogPartError struct {
+    LogId  int
+    Number int
+    Err    error
+}
+
+func (e *CreateLogPartError) Error() string {
+    return fmt.Sprintf("createLogPart: log_id:%d number:%d - %v", e.LogId, e.Number, e.Err)
+}
+
+// StreamToPusherError is returned when a log part could not be streamed to
+// the live clients.
+type StreamToPusherError struct {
+    JobId  int
+    Number int
+    Err    error
+}
+
+func (e *StreamToPusherError) Error() string {
+    return fmt.Sprintf("streamToPusher: job_id:%d number:%d - %v", e.JobId, e.Number, e.Err)
+}
+
+// LogNotFoundError is returned by FindLogId when there is no log for a job.
+type LogNotFoundError struct {
+    JobId int
+}
+
+func (e *LogNotFoundError) Error() string {
+    return fmt.Sprintf("FindLogId: no log with job_id:%d found", e.JobId)
+}
+
+// LogPartsAggregatedError is returned by FindLogWithParts when parts after
+// the requested number were aggregated, and are only part of the log content.
+type LogPartsAggregatedError struct {
+    JobId int
+    After int
+}
+
+func (e *LogPartsAggregatedError) Error() string {
+    return fmt.Sprintf("FindLogWithParts: parts of job_id:%d after number %d were aggregated", e.JobId, e.After)
+}
+
+// DBError wraps an error returned by the database driver for a query.
+type DBError struct {
+    Op  string
+    Err error
+}
+
+func (e *DBError) Error() string {
+    return fmt.Sprintf("%s: db query failed: %v", e.Op, e.Err)
+}
+
+// PusherPublishError is returned when Pusher did not accept an event.
+// Transient is set when the request never got an answer or Pusher answered
+// with a server error, so trying again later may succeed.
+type PusherPublishError struct {
+    Err       error
+    Transient bool
+}
+
+func (e *PusherPublishError) Error() string {
+    return fmt.Sprintf("Publish: error publishing to pusher: %v", e.Err)
+}
+
+// isTransientError reports whether the failure behind err is likely to go
+// away on its own, such as a dropped connection or a Pusher outage, as
+// opposed to a message that will never be processable.
+func isTransientError(err error) bool {
+    switch e := err.(type) {
+    case *ParseError:
+        return false
+    case *FindLogIdError:
+        return isTransientError(e.Err)
+    case *CreateLogPartError:
+        return isTransientError(e.Err)
+    case *StreamToPusherError:
+        return isTransientError(e.Err)
+    case *LogNotFoundError:
+        // the log part may have raced the creation of its log, it is dead
+        // lettered once it runs out of attempts
+        return true
+    case *DBError:
+        return isTransientDBError(e.Err)
+    case *PusherPublishError:
+        return e.Transient
+    }
+
+    return false
+}
+
+// countPusherError counts a failed publish by its cause, and reports whether
+// it failed for real. A publish stopped by the open circuit breaker or timing
+// out is only counted: the part is stored, and publishing it again could
+// stream it twice as Pusher may still accept the abandoned request.
+func countPusherError(err error) bool {
+    switch {
+    case err == nil:
+        return false
+    case isCircuitOpenError(err):
+        appMetrics.MarkShortCircuitedPusherCount()
+        return false
+    case isPusherTimeoutError(err):
+        appMetrics.MarkTimedOutPusherCount()
+        return false
+    }
+
+    appMetrics.MarkFailedPusherCount()
+    return true
+}
+
+func isTransientDBError(err error) bool {
+    switch err {
+    case driver.ErrBadConn, io.EOF, io.ErrUnexpectedEOF, context.DeadlineExceeded, context.Canceled, errBatcherClosed:
+        return true
+    }
+
+    switch e := err.(type) {
+    case net.Error:
+        return true
+    case *pq.Error:
+        return isTransientPostgresError(e.Code)
+    }
+
+    return false
+}
+
+// isTransientPostgresError checks the SQLSTATE class of the error, see
+// http://www.postgresql.org/docs/current/static/errcodes-appendix.html
+func isTransientPostgresError(code pq.ErrorCode) bool {
+    switch code.Class() {
+    case "08", // connection exception
+        "40", // transaction rollback, including serialization failures and deadlocks
+        "53", // insufficient resources
+        "57": // operator intervention, such as a server shutdown
+        return true
+    }
+
+    return code == "55P03" // lock not available
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+    "hash/crc32"
+    "sort"
+    "strconv"
+)
+
+// HashRing maps keys onto nodes with consistent hashing: every node is
+// placed on the ring replicas times, and a key belongs to the first node
+// after its hash. Adding or removing a node only moves the keys next to its
+// points.
+type HashRing struct {
+    replicas int
+    hashes   []uint32
+    nodes    map[uint32]int
+}
+
+func NewHashRing(replicas int) *HashRing {
+    return &HashRing{replicas: replicas, nodes: map[uint32]int{}}
+}
+
+func (r *HashRing) Add(node int) {
+    for i := 0; i < r.replicas; i++ {
+        hash := ringHash(strconv.Itoa(node) + "-" + strconv.Itoa(i))
+        if _, taken := r.nodes[hash]; taken {
+            continue
+        }
+        r.nodes[hash] = node
+        r.hashes = append(r.hashes, hash)
+    }
+
+    sort.Slice(r.hashes, func(i, j int) bool { return r.hashes[i] < r.hashes[j] })
+}
+
+func (r *HashRing) Remove(node int) {
+    hashes := r.hashes[:0]
+    for _, hash := range r.hashes {
+        if r.nodes[hash] == node {
+            delete(r.nodes, hash)
+            continue
+        }
+        hashes = append(hashes, hash)
+    }
+    r.hashes = hashes
+}
+
+// Get returns the node key belongs to, false when the ring is empty.
+func (r *HashRing) Get(key string) (int, bool) {
+    if len(r.hashes) == 0 {
+        return 0, false
+    }
+
+    hash := ringHash(key)
+    i := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= hash })
+    if i == len(r.hashes) {
+        i = 0
+    }
+
+    return r.nodes[r.hashes[i]], true
+}
+
+func ringHash(key string) uint32 {
+    return crc32.ChecksumIEEE([]byte(key))
+}
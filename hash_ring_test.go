@@ -0,0 +1,75 @@
+package main
+
+import (
+    "strconv"
+    "testing"
+)
+
+func TestHashRingEmpty(t *testing.T) {
+    ring := NewHashRing(shardReplicas)
+
+    if _, ok := ring.Get("1"); ok {
+        t.Error("expected an empty ring not to return a node")
+    }
+
+    ring.Add(1)
+    ring.Remove(1)
+
+    if _, ok := ring.Get("1"); ok {
+        t.Error("expected a ring without nodes left not to return a node")
+    }
+}
+
+func TestHashRingDistribution(t *testing.T) {
+    ring := NewHashRing(shardReplicas)
+    for node := 0; node < 4; node++ {
+        ring.Add(node)
+    }
+
+    counts := map[int]int{}
+    for i := 0; i < 10000; i++ {
+        node, ok := ring.Get(strconv.Itoa(i))
+        if !ok {
+            t.Fatal("expected a node")
+        }
+        counts[node]++
+    }
+
+    for node := 0; node < 4; node++ {
+        if counts[node] < 10000/4/2 {
+            t.Errorf("node %d got %d of 10000 keys, expected about a quarter", node, counts[node])
+        }
+    }
+}
+
+func TestHashRingStability(t *testing.T) {
+    ring := NewHashRing(shardReplicas)
+    for node := 0; node < 4; node++ {
+        ring.Add(node)
+    }
+
+    before := map[string]int{}
+    for i := 0; i < 1000; i++ {
+        key := strconv.Itoa(i)
+        before[key], _ = ring.Get(key)
+    }
+
+    ring.Add(4)
+    for key, node := range before {
+        if moved, _ := ring.Get(key); moved != node && moved != 4 {
+            t.Errorf("adding node 4 moved key %s from node %d to %d", key, node, moved)
+        }
+    }
+
+    ring.Remove(4)
+    ring.Remove(2)
+    for key, node := range before {
+        moved, _ := ring.Get(key)
+        if node != 2 && moved != node {
+            t.Errorf("removing node 2 moved key %s from node %d to %d", key, node, moved)
+        }
+        if moved == 2 {
+            t.Errorf("key %s still belongs to the removed node 2", key)
+        }
+    }
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+    "context"
+    "sync"
+)
+
+// subscriberBuffer is how many events a subscriber may fall behind before it
+// is dropped, so that a slow client never holds up publishing.
+const subscriberBuffer = 256
+
+// LocalHub is a Pusher which fans log parts out to in-process subscribers,
+// such as the clients of the SSE endpoint. On its own it only sees the log
+// parts processed by this process, a PostgresHub feeds it those of all
+// processes.
+type LocalHub struct {
+    mu          sync.Mutex
+    subscribers map[int]map[chan PusherPayload]bool
+}
+
+func NewLocalHub() *LocalHub {
+    return &LocalHub{subscribers: map[int]map[chan PusherPayload]bool{}}
+}
+
+func (h *LocalHub) Publish(ctx context.Context, jobId int, number int, content string, final bool) error {
+    payload := PusherPayload{
+        JobId:   jobId,
+        Number:  number,
+        Content: content,
+        Final:   final,
+    }
+
+    h.PublishPayload(payload)
+    return nil
+}
+
+// PublishPayload hands payload to the subscribers of its job.
+func (h *LocalHub) PublishPayload(payload PusherPayload) {
+    jobId := payload.JobId
+
+    h.mu.Lock()
+    defer h.mu.Unlock()
+
+    for events := range h.subscribers[jobId] {
+        select {
+        case events <- payload:
+        default:
+            h.unsubscribe(jobId, events)
+        }
+    }
+}
+
+// Subscribe returns a channel receiving the log parts of a job and a function
+// to unsubscribe again. The channel is closed on unsubscribe, or when the
+// subscriber fell too far behind.
+func (h *LocalHub) Subscribe(jobId int) (<-chan PusherPayload, func()) {
+    events := make(chan PusherPayload, subscriberBuffer)
+
+    h.mu.Lock()
+    if h.subscribers[jobId] == nil {
+        h.subscribers[jobId] = map[chan PusherPayload]bool{}
+    }
+    h.subscribers[jobId][events] = true
+    h.mu.Unlock()
+
+    return events, func() {
+        h.mu.Lock()
+        defer h.mu.Unlock()
+
+        h.unsubscribe(jobId, events)
+    }
+}
+
+func (h *LocalHub) unsubscribe(jobId int, events chan PusherPayload) {
+    if !h.subscribers[jobId][events] {
+        return
+    }
+
+    delete(h.subscribers[jobId], events)
+    if len(h.subscribers[jobId]) == 0 {
+        delete(h.subscribers, jobId)
+    }
+    close(events)
+}
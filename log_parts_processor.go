@@ -1,9 +1,10 @@
 package main
 
 import (
-    "fmt"
+    "context"
     "strings"
-    // "strconv"
+    "time"
+    "strconv"
     "encoding/json"
 )
 
@@ -15,32 +16,41 @@ type Payload struct {
     UUID    string `json:"uuid"`
 }
 
+// StageTimeouts are the deadlines for the individual processing stages of a
+// log part, a stage taking longer fails with a retryable error.
+type StageTimeouts struct {
+    FindLogId      time.Duration
+    CreateLogPart  time.Duration
+    StreamToPusher time.Duration
+}
+
+// StageRetries are the retry policies for the individual processing stages.
+type StageRetries struct {
+    FindLogId      RetryPolicy
+    CreateLogPart  RetryPolicy
+    StreamToPusher RetryPolicy
+}
+
 type LogPartsProcessor struct {
     db           DB
     pusherClient Pusher
+    timeouts     StageTimeouts
+    retries      StageRetries
+
+    // createMissingLogs creates the log of a job when its first log parts
+    // arrive before the log was created elsewhere.
+    createMissingLogs bool
+
+    // sequences, when set, is told about every stored log part to detect
+    // gaps and duplicates.
+    sequences *SequenceTracker
 }
 
-func (lpp *LogPartsProcessor) Process(message []byte) error {
+func (lpp *LogPartsProcessor) Process(ctx context.Context, message []byte) error {
     var err error
 
     appMetrics.TimeLogPartProcessing(func() {
-        payload, err := lpp.parseMessageBody(message)
-        if err != nil {
-            return
-        }
-
-        logId, err := lpp.findLogId(payload)
-        if err != nil {
-            return
-        }
-
-        if err = lpp.createLogPart(logId, payload); err != nil {
-            return
-        }
-
-        if err = lpp.streamToPusher(payload); err != nil {
-            return
-        }
+        err = lpp.process(ctx, message)
     })
 
     if err != nil {
@@ -51,12 +61,63 @@ func (lpp *LogPartsProcessor) Process(message []byte) error {
     return nil
 }
 
+// Retryable reports whether a message which failed with err should be
+// processed again later.
+func (lpp *LogPartsProcessor) Retryable(err error) bool {
+    return isTransientError(err)
+}
+
+// Close is a no-op, the database handle is shared by all processors and is
+// closed by whoever opened it.
+func (lpp *LogPartsProcessor) Close() {
+}
+
+func (lpp *LogPartsProcessor) process(ctx context.Context, message []byte) error {
+    payload, err := lpp.parseMessageBody(message)
+    if err != nil {
+        return err
+    }
+
+    logId, err := lpp.findLogId(ctx, payload)
+    if err != nil {
+        return err
+    }
+
+    if err = lpp.createLogPart(ctx, logId, payload); err != nil {
+        return err
+    }
+
+    if lpp.sequences != nil {
+        lpp.sequences.Track(payload.JobId, payload.Number, payload.Final)
+    }
+
+    // a part which was already stored is streamed as well, the attempt which
+    // stored it may have failed or timed out before streaming it. Live
+    // clients skip the parts they have seen.
+    return lpp.streamToPusher(ctx, payload)
+}
+
+// ShardKey returns the job id of a log part, so that the parts of a job are
+// processed in order.
+func (lpp *LogPartsProcessor) ShardKey(message []byte) (string, bool) {
+    var payload struct {
+        JobId int `json:"id"`
+    }
+
+    if err := json.Unmarshal(message, &payload); err != nil {
+        return "", false
+    }
+
+    return strconv.Itoa(payload.JobId), true
+}
+
 func (lpp *LogPartsProcessor) parseMessageBody(message []byte) (*Payload, error) {
     payload := &Payload{}
     err := json.Unmarshal(message, payload)
 
     if err != nil {
-        return nil, fmt.Errorf("parseMessageBody: error during json.unmarshal: %v", err)
+        appMetrics.MarkFailedParseCount()
+        return nil, &ParseError{err}
     }
 
     payload.Content = strings.Replace(payload.Content, "\x00", "", -1)
@@ -66,39 +127,82 @@ func (lpp *LogPartsProcessor) parseMessageBody(message []byte) (*Payload, error)
     return payload, nil
 }
 
-// add a timeout and retry
-func (lpp *LogPartsProcessor) findLogId(payload *Payload) (int, error) {
-    logId, err := lpp.db.FindLogId(payload.JobId)
+func (lpp *LogPartsProcessor) findLogId(ctx context.Context, payload *Payload) (int, error) {
+    var logId int
+
+    err := lpp.retries.FindLogId.Do(ctx, "find_log_id", func() error {
+        ctx, cancel := context.WithTimeout(ctx, lpp.timeouts.FindLogId)
+        defer cancel()
+
+        var err error
+        logId, err = lpp.db.FindLogId(ctx, payload.JobId)
+        if _, notFound := err.(*LogNotFoundError); notFound && lpp.createMissingLogs {
+            var created bool
+            logId, created, err = lpp.db.FindOrCreateLogId(ctx, payload.JobId)
+            if created {
+                appMetrics.MarkAutoCreatedLogCount()
+            }
+        }
+        return err
+    })
 
     if err != nil {
-        return -1, err
+        appMetrics.MarkFailedFindLogIdCount()
+        return -1, &FindLogIdError{payload.JobId, err}
     }
 
     return logId, nil
 }
 
-// add a timeout and retry
-func (lpp *LogPartsProcessor) createLogPart(logId int, payload *Payload) error {
-    err := lpp.db.CreateLogPart(logId, payload.Number, payload.Content, payload.Final)
+// createLogPart stores the log part, counting the parts which were already
+// stored.
+func (lpp *LogPartsProcessor) createLogPart(ctx context.Context, logId int, payload *Payload) error {
+    var created bool
 
-    if err != nil {
+    err := lpp.retries.CreateLogPart.Do(ctx, "create_log_part", func() error {
+        ctx, cancel := context.WithTimeout(ctx, lpp.timeouts.CreateLogPart)
+        defer cancel()
+
+        var err error
+        created, err = lpp.db.CreateLogPart(ctx, logId, payload.Number, payload.Content, payload.Final)
         return err
+    })
+
+    if err != nil {
+        appMetrics.MarkFailedCreateLogPartCount()
+        return &CreateLogPartError{logId, payload.Number, err}
+    }
+
+    if !created {
+        appMetrics.MarkDuplicateLogPartCount()
     }
 
     return nil
 }
 
-// add a timeout and retry
-func (lpp *LogPartsProcessor) streamToPusher(payload *Payload) error {
-    var err error
+func (lpp *LogPartsProcessor) streamToPusher(ctx context.Context, payload *Payload) error {
+    // a queueing Pusher times and retries the publish itself, failing to
+    // queue the part means nothing was sent
+    if qp, ok := lpp.pusherClient.(QueueingPusher); ok && qp.Queued() {
+        if err := lpp.pusherClient.Publish(ctx, payload.JobId, payload.Number, payload.Content, payload.Final); err != nil {
+            return &StreamToPusherError{payload.JobId, payload.Number, err}
+        }
+        return nil
+    }
 
-    appMetrics.TimePusher(func() {
-        err = lpp.pusherClient.Publish(payload.JobId, payload.Number, payload.Content, payload.Final)
-    })
+    err := lpp.retries.StreamToPusher.Do(ctx, "pusher", func() error {
+        ctx, cancel := context.WithTimeout(ctx, lpp.timeouts.StreamToPusher)
+        defer cancel()
 
-    if err != nil {
-        appMetrics.MarkFailedPusherCount()
+        var err error
+        appMetrics.TimePusher(func() {
+            err = lpp.pusherClient.Publish(ctx, payload.JobId, payload.Number, payload.Content, payload.Final)
+        })
         return err
+    })
+
+    if countPusherError(err) {
+        return &StreamToPusherError{payload.JobId, payload.Number, err}
     }
 
     return nil
@@ -0,0 +1,304 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "log"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// LogServer serves the logs of jobs over HTTP:
+//
+//   GET /jobs/:id/log
+//
+// returns the log as text/plain, or as JSON when the request accepts
+// application/json. Text responses support Range requests, and ?after=<number>
+// only returns the log parts with a greater number, for incremental fetches.
+// Once those parts were aggregated the response is 410 Gone, and the client
+// has to fetch the whole log again.
+//
+//   GET /jobs/:id/log/events
+//
+// streams the log as Server-Sent Events when the server has a LocalHub. The
+// stored log parts are replayed first, starting after the Last-Event-ID when
+// reconnecting, followed by the live log parts. When the parts after the
+// Last-Event-ID were aggregated meanwhile, a job:log:reset event tells the
+// client to discard what it has, and the whole log is replayed. A log part is
+// only sent once per stream, also when it is published again.
+type LogServer struct {
+    db      DB
+    timeout time.Duration
+    hub     *LocalHub
+}
+
+type logResponse struct {
+    Id         int               `json:"id"`
+    JobId      int               `json:"job_id"`
+    Content    string            `json:"content"`
+    Aggregated bool              `json:"aggregated"`
+    Parts      []logPartResponse `json:"parts"`
+}
+
+type logPartResponse struct {
+    Number  int    `json:"number"`
+    Content string `json:"content"`
+    Final   bool   `json:"final"`
+}
+
+// sseKeepAlive is how often an idle event stream sends a comment, so that
+// proxies don't close the connection.
+const sseKeepAlive = 15 * time.Second
+
+// NewLogServer returns a LogServer reading logs from db, hub may be nil when
+// live logs are not available.
+func NewLogServer(db DB, timeout time.Duration, hub *LocalHub) *LogServer {
+    return &LogServer{db, timeout, hub}
+}
+
+func (s *LogServer) Handler() http.Handler {
+    mux := http.NewServeMux()
+    mux.HandleFunc("/jobs/", s.serveJob)
+    return mux
+}
+
+func (s *LogServer) serveJob(w http.ResponseWriter, r *http.Request) {
+    jobId, rest, ok := parseJobPath(r.URL.Path)
+    if !ok || (rest != "log" && rest != "log/events") || (rest == "log/events" && s.hub == nil) {
+        http.NotFound(w, r)
+        return
+    }
+
+    if r.Method != "GET" && r.Method != "HEAD" {
+        w.Header().Set("Allow", "GET, HEAD")
+        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    if rest == "log/events" {
+        s.serveLogEvents(w, r, jobId)
+        return
+    }
+
+    s.serveLog(w, r, jobId)
+}
+
+func (s *LogServer) serveLogEvents(w http.ResponseWriter, r *http.Request, jobId int) {
+    flusher, ok := w.(http.Flusher)
+    if !ok {
+        http.Error(w, "streaming not supported", http.StatusInternalServerError)
+        return
+    }
+
+    lastEventId := -1
+    if v := r.Header.Get("Last-Event-ID"); v != "" {
+        var err error
+        if lastEventId, err = strconv.Atoi(v); err != nil {
+            http.Error(w, "Last-Event-ID must be a log part number", http.StatusBadRequest)
+            return
+        }
+    }
+
+    // subscribe before replaying, so that no part falls between the two
+    events, unsubscribe := s.hub.Subscribe(jobId)
+    defer unsubscribe()
+
+    w.Header().Set("Content-Type", "text/event-stream")
+    w.Header().Set("Cache-Control", "no-cache")
+    w.WriteHeader(http.StatusOK)
+
+    sent, final, err := s.replayLogEvents(w, r.Context(), jobId, lastEventId)
+    if err != nil {
+        log.Printf("serveLogEvents: error replaying the log for job_id:%d - %v", jobId, err)
+        return
+    }
+    flusher.Flush()
+
+    if final {
+        return
+    }
+
+    keepAlive := time.NewTicker(sseKeepAlive)
+    defer keepAlive.Stop()
+
+    for {
+        select {
+        case payload, ok := <-events:
+            if !ok {
+                return
+            }
+            if sent[payload.Number] {
+                continue
+            }
+            if err = writeLogEvent(w, payload); err != nil {
+                return
+            }
+            // the chunks of a split part share its number
+            if payload.Chunk == payload.Chunks {
+                sent[payload.Number] = true
+            }
+            flusher.Flush()
+            if payload.Final {
+                return
+            }
+        case <-keepAlive.C:
+            if _, err = fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+                return
+            }
+            flusher.Flush()
+        case <-r.Context().Done():
+            return
+        }
+    }
+}
+
+// replayLogEvents writes the stored log parts after lastEventId, returning the
+// numbers written and whether the final part was among them.
+func (s *LogServer) replayLogEvents(w http.ResponseWriter, ctx context.Context, jobId int, lastEventId int) (map[int]bool, bool, error) {
+    ctx, cancel := context.WithTimeout(ctx, s.timeout)
+    defer cancel()
+
+    replayed := map[int]bool{}
+
+    l, parts, err := s.db.FindLogWithParts(ctx, jobId, lastEventId)
+    if _, gone := err.(*LogPartsAggregatedError); gone {
+        if _, err = fmt.Fprintf(w, "event: job:log:reset\ndata: {\"id\":%d}\n\n", jobId); err != nil {
+            return nil, false, err
+        }
+
+        lastEventId = -1
+        l, parts, err = s.db.FindLogWithParts(ctx, jobId, lastEventId)
+    }
+    if _, notFound := err.(*LogNotFoundError); notFound {
+        return replayed, false, nil
+    }
+    if err != nil {
+        return nil, false, err
+    }
+
+    // the parts of an aggregated log are gone, send its content without an id
+    if lastEventId < 0 && l.Content != "" {
+        if err = writeLogEvent(w, PusherPayload{JobId: jobId, Number: -1, Content: l.Content}); err != nil {
+            return nil, false, err
+        }
+    }
+
+    final := false
+    for _, part := range parts {
+        if err = writeLogEvent(w, PusherPayload{JobId: jobId, Number: part.Number, Content: part.Content, Final: part.Final}); err != nil {
+            return nil, false, err
+        }
+        replayed[part.Number] = true
+        final = final || part.Final
+    }
+
+    return replayed, final || (l.AggregatedAt != nil && len(parts) == 0), nil
+}
+
+// writeLogEvent writes a log part as a job:log event, with the part number as
+// the event id. Payloads without a part number are written without an id.
+func writeLogEvent(w http.ResponseWriter, payload PusherPayload) error {
+    data, err := json.Marshal(&payload)
+    if err != nil {
+        return err
+    }
+
+    if payload.Number >= 0 {
+        if _, err = fmt.Fprintf(w, "id: %d\n", payload.Number); err != nil {
+            return err
+        }
+    }
+
+    _, err = fmt.Fprintf(w, "event: job:log\ndata: %s\n\n", data)
+    return err
+}
+
+func (s *LogServer) serveLog(w http.ResponseWriter, r *http.Request, jobId int) {
+    after := -1
+    if v := r.URL.Query().Get("after"); v != "" {
+        var err error
+        if after, err = strconv.Atoi(v); err != nil {
+            http.Error(w, "after must be a log part number", http.StatusBadRequest)
+            return
+        }
+    }
+
+    ctx, cancel := context.WithTimeout(r.Context(), s.timeout)
+    defer cancel()
+
+    l, parts, err := s.db.FindLogWithParts(ctx, jobId, after)
+    if _, notFound := err.(*LogNotFoundError); notFound {
+        http.NotFound(w, r)
+        return
+    }
+    if _, gone := err.(*LogPartsAggregatedError); gone {
+        http.Error(w, "the log parts after this number were aggregated, fetch the whole log", http.StatusGone)
+        return
+    }
+    if err != nil {
+        log.Printf("serveLog: error finding the log for job_id:%d - %v", jobId, err)
+        http.Error(w, "internal server error", http.StatusInternalServerError)
+        return
+    }
+
+    // the aggregated content holds the parts which are gone from log_parts,
+    // an incremental fetch only wants the parts after the given number
+    var builder strings.Builder
+    if after < 0 {
+        builder.WriteString(l.Content)
+    }
+    for _, part := range parts {
+        builder.WriteString(part.Content)
+    }
+    content := builder.String()
+
+    if acceptsJSON(r) {
+        response := logResponse{
+            Id:         l.Id,
+            JobId:      l.JobId,
+            Content:    content,
+            Aggregated: l.AggregatedAt != nil,
+            Parts:      make([]logPartResponse, len(parts)),
+        }
+        for i, part := range parts {
+            response.Parts[i] = logPartResponse{part.Number, part.Content, part.Final}
+        }
+
+        w.Header().Set("Content-Type", "application/json")
+        if err = json.NewEncoder(w).Encode(&response); err != nil {
+            log.Printf("serveLog: error writing the log for job_id:%d - %v", jobId, err)
+        }
+        return
+    }
+
+    var modified time.Time
+    if l.AggregatedAt != nil && len(parts) == 0 {
+        modified = *l.AggregatedAt
+    }
+
+    w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+    http.ServeContent(w, r, "", modified, strings.NewReader(content))
+}
+
+// parseJobPath splits a /jobs/:id/... path into the job id and the rest of
+// the path.
+func parseJobPath(path string) (int, string, bool) {
+    segments := strings.SplitN(strings.TrimPrefix(path, "/jobs/"), "/", 2)
+    if len(segments) != 2 {
+        return 0, "", false
+    }
+
+    jobId, err := strconv.Atoi(segments[0])
+    if err != nil {
+        return 0, "", false
+    }
+
+    return jobId, segments[1], true
+}
+
+func acceptsJSON(r *http.Request) bool {
+    return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
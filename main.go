@@ -3,12 +3,66 @@ package main
 import (
     "flag"
     "log"
+    "time"
 )
 
 var process = flag.String("process", "streaming", "The process to start")
+var configFile = flag.String("config", "", "JSON file with the consumer settings, overridden by their environment variables and flags")
+var queueName = flag.String("queue", "reporting.jobs.logs", "Queue the log parts are consumed from ($LOGS_QUEUE)")
+var subscriptions = flag.Int("subscriptions", 1, "How many AMQP consumers are opened on the queue, more than one doesn't keep the log parts of a job in order ($LOGS_SUBSCRIPTIONS)")
+var consumers = flag.Int("consumers", 30, "How many log parts each subscription processes concurrently ($LOGS_CONSUMERS)")
+var prefetch = flag.Int("prefetch", 0, "How many unacked log parts each subscription is sent, 0 is 3 per consumer ($LOGS_PREFETCH)")
+var shutdownTimeout = flag.Duration("shutdown-timeout", 20*time.Second, "How long in-flight log parts are given to finish on shutdown")
+var dbMaxOpenConns = flag.Int("db-max-open-conns", 20, "Maximum number of open database connections, 0 is unlimited")
+var dbMaxIdleConns = flag.Int("db-max-idle-conns", 10, "Maximum number of idle database connections")
+var dbConnMaxLifetime = flag.Duration("db-conn-max-lifetime", 30*time.Minute, "How long a database connection is reused, 0 is forever")
+var findLogIdTimeout = flag.Duration("find-log-id-timeout", 3*time.Second, "Deadline for looking up the log of a log part")
+var createLogPartTimeout = flag.Duration("create-log-part-timeout", 3*time.Second, "Deadline for storing a log part")
+var streamToPusherTimeout = flag.Duration("stream-to-pusher-timeout", 3*time.Second, "Deadline for streaming a log part to Pusher")
+var createMissingLogs = flag.Bool("create-missing-logs", false, "Create the log of a job when none exists yet instead of retrying its log parts until they are dead lettered")
+var logIdCacheSize = flag.Int("log-id-cache-size", 10000, "How many job id to log id lookups are cached, 0 disables the cache")
+var logIdCacheTTL = flag.Duration("log-id-cache-ttl", 10*time.Minute, "How long a cached log id is used")
+var logIdCacheNegativeTTL = flag.Duration("log-id-cache-negative-ttl", 2*time.Second, "How long a job without a log is cached")
+var logPartBatchSize = flag.Int("log-part-batch-size", 25, "How many log parts are written with a single COPY, 0 disables batching")
+var logPartBatchWait = flag.Duration("log-part-batch-wait", 20*time.Millisecond, "How long a batch of log parts waits to fill up before it is written")
+var findLogIdRetry = RetryPolicy{MaxAttempts: 3, BaseDelay: 50 * time.Millisecond, MaxDelay: time.Second, Jitter: 0.2}
+var createLogPartRetry = RetryPolicy{MaxAttempts: 3, BaseDelay: 50 * time.Millisecond, MaxDelay: time.Second, Jitter: 0.2}
+var streamToPusherRetry = RetryPolicy{MaxAttempts: 2, BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second, Jitter: 0.2}
+var httpRequestTimeout = flag.Duration("http-request-timeout", 10*time.Second, "Deadline for the database queries of an HTTP request")
+var pusherEnabled = flag.Bool("pusher", true, "Stream log parts to Pusher")
+var pusherCoalesceWindow = flag.Duration("pusher-coalesce-window", 0, "How long the log parts of a job are merged into a single Pusher event, 0 disables coalescing")
+var pusherOccupancyInterval = flag.Duration("pusher-occupancy-interval", 0, "How often the occupied job channels are fetched from Pusher to skip publishing to vacant ones, 0 publishes to all")
+var pusherBreakerFailures = flag.Int("pusher-breaker-failures", 5, "How many consecutive failed Pusher publishes open the circuit breaker, 0 disables it")
+var pusherBreakerSuccesses = flag.Int("pusher-breaker-successes", 1, "How many successful probes close the open Pusher circuit breaker again")
+var pusherBreakerCooldown = flag.Duration("pusher-breaker-cooldown", 10*time.Second, "How long the Pusher circuit breaker stays open before probing Pusher")
+var pusherQueueSize = flag.Int("pusher-queue-size", 0, "How many log parts are queued for streaming without holding up storing them, 0 streams them before acking")
+var pusherQueueWorkers = flag.Int("pusher-queue-workers", 4, "How many workers stream the queued log parts")
+var pusherQueueOverflow = DropOldest
+var trackSequences = flag.Bool("track-sequences", false, "Warn about gaps, duplicates and log parts after the final one, needs all parts of a job to be consumed by the same process")
+var sequenceTTL = flag.Duration("sequence-ttl", 10*time.Minute, "How long the log part numbers of a job are tracked after its last log part, by -track-sequences and -reorder-window")
+var reorderWindow = flag.Duration("reorder-window", 0, "How long log parts arriving ahead of a missing one are held back from live clients, 0 streams them right away")
+var ssePort = flag.String("sse-port", "", "Port serving the logs and live Server-Sent Events from the streaming process, empty to disable")
+var webSocketPort = flag.String("websocket-port", "", "Port serving the Pusher client protocol over WebSockets from the streaming process, empty to disable")
+var webSocketOrigins = flag.String("websocket-origins", "", "Comma separated origins browsers may open WebSockets from, * for any, empty for the server's own host")
+var aggregateInterval = flag.Duration("aggregate-interval", 5*time.Second, "How long the aggregator sleeps when there is nothing to aggregate")
+var aggregateBatchSize = flag.Int("aggregate-batch-size", 100, "How many logs the aggregator picks up per run")
+var aggregateGracePeriod = flag.Duration("aggregate-grace-period", time.Minute, "How long the aggregator waits after the last log part of a log, for parts arriving out of order")
 
 func init() {
     log.SetFlags(0)
+
+    flag.Var(&findLogIdRetry, "find-log-id-retry", "Retry policy for looking up the log of a log part, e.g. attempts=3,base=50ms,max=1s,jitter=0.2")
+    flag.Var(&createLogPartRetry, "create-log-part-retry", "Retry policy for storing a log part")
+    flag.Var(&streamToPusherRetry, "stream-to-pusher-retry", "Retry policy for streaming a log part to Pusher")
+    flag.Var(&pusherQueueOverflow, "pusher-queue-overflow", "What happens to log parts when the streaming queue is full: drop-oldest, drop-newest or block")
+}
+
+func dbPoolConfig() PoolConfig {
+    return PoolConfig{
+        MaxOpenConns:    *dbMaxOpenConns,
+        MaxIdleConns:    *dbMaxIdleConns,
+        ConnMaxLifetime: *dbConnMaxLifetime,
+    }
 }
 
 func main() {
@@ -17,7 +71,13 @@ func main() {
     case "streaming":
         startLogPartsProcessing()
     case "aggregate":
-        panic("aggregate not supported yet")
+        startLogAggregation()
+    case "replay":
+        startDeadLetterReplay()
+    case "http":
+        startHTTPServer()
+    case "migrate":
+        startMigration(flag.Arg(0))
     default:
         panic("Invalid process option selected")
     }
@@ -1,89 +1,563 @@
 package main
 
 import (
+    "context"
+    "errors"
+    "fmt"
     "github.com/streadway/amqp"
     "log"
     "sync"
+    "time"
+)
+
+const (
+    deadLetterExchange = "reporting.dead_letter"
+
+    // maxDeliveryAttempts is how often a message failing with a retryable
+    // error is processed before it is dead lettered.
+    maxDeliveryAttempts = 5
+
+    // retryDelay is how long a retried message waits in the retry queue
+    // before it is put back on its queue.
+    retryDelay = 5 * time.Second
+
+    attemptsHeader      = "x-attempts"
+    failureReasonHeader = "x-failure-reason"
+    originalQueueHeader = "x-original-queue"
+    replayedHeader      = "x-replayed"
+
+    consumerTag = "processor"
+
+    reconnectBaseDelay = 500 * time.Millisecond
+    reconnectMaxDelay  = 30 * time.Second
 )
 
 type MessageBroker interface {
-    Subscribe(string, int, func(int) MessageProcessor) error
+    Subscribe(string, int, int, func(int) MessageProcessor) error
+    ReplayDeadLetters(string) (int, error)
+    Stop()
     Close()
 }
 
 type MessageProcessor interface {
-    Process(message []byte) error
+    Process(ctx context.Context, message []byte) error
+    Retryable(err error) bool
+    Close()
 }
 
+var errBrokerClosed = errors.New("message broker closed")
+
+// RabbitMessageBroker keeps a connection to RabbitMQ open, dialing again
+// with a backoff whenever the connection is lost. Subscriptions survive a
+// reconnect, they consume again once the topology has been re-declared.
 type RabbitMessageBroker struct {
-    conn *amqp.Connection
+    ctx       context.Context
+    cancel    context.CancelFunc
+    url       string
+    queueName string
+    mu        sync.Mutex
+    cond      *sync.Cond
+    conn      *amqp.Connection
+    consumers map[*amqp.Channel]bool
+    pools     map[string]*shardPool
+    stopping  bool
+    closed    bool
+}
+
+func (mb *RabbitMessageBroker) Subscribe(queueName string, subCount int, prefetch int, f func(int) MessageProcessor) error {
+    if subCount < 1 {
+        return fmt.Errorf("Subscribe: at least one processor is needed for %s", queueName)
+    }
+
+    processors := make([]MessageProcessor, 0, subCount)
+    defer func() {
+        for _, processor := range processors {
+            processor.Close()
+        }
+    }()
+
+    for i := 0; i < subCount; i++ {
+        processor := f(i)
+        if processor == nil {
+            return fmt.Errorf("Subscribe: processor %d for %s could not be created", i+1, queueName)
+        }
+        processors = append(processors, processor)
+    }
+
+    // the processors work for every subscription of the queue, so that the
+    // messages with the same shard key are processed in order
+    pool := mb.shardPool(queueName)
+    for _, processor := range processors {
+        processor := processor
+        id := pool.join(func(publisher *confirmPublisher, message amqp.Delivery) {
+            deliver(mb.ctx, publisher, queueName, processor, message)
+        })
+        defer pool.leave(id)
+    }
+
+    keyer, _ := processors[0].(ShardKeyer)
+
+    var stale *amqp.Connection
+    failures := 0
+
+    for {
+        ch, conn, err := mb.awaitChannel(stale)
+        if err == errBrokerClosed {
+            return nil
+        }
+        if err != nil {
+            stale = conn
+            continue
+        }
+
+        var messages <-chan amqp.Delivery
+        publisher, err := newConfirmPublisher(conn)
+        if err == nil {
+            if messages, err = consume(ch, queueName, prefetch); err != nil {
+                publisher.Close()
+            }
+        }
+        if err != nil {
+            ch.Close()
+            if mb.isStopped() {
+                return nil
+            }
+
+            failures++
+            log.Printf("Subscribe: error consuming from %s (attempt %d) - %v", queueName, failures, err)
+            time.Sleep(backoffDelay(failures, reconnectBaseDelay, reconnectMaxDelay, 0.5))
+            continue
+        }
+        failures = 0
+
+        if !mb.addConsumer(ch) {
+            publisher.Close()
+            ch.Close()
+            return nil
+        }
+
+        var wg sync.WaitGroup
+        for message := range messages {
+            var key string
+            var hasKey bool
+            if keyer != nil {
+                key, hasKey = keyer.ShardKey(message.Body)
+            }
+            if err := pool.dispatch(key, hasKey, publisher, message, &wg); err != nil {
+                log.Printf("Subscribe: error dispatching message from %s, requeueing - %v", queueName, err)
+                message.Nack(false, true)
+            }
+        }
+        wg.Wait()
+
+        mb.removeConsumer(ch)
+        publisher.Close()
+        ch.Close()
+        if mb.isStopped() {
+            return nil
+        }
+
+        log.Printf("Subscribe: lost the consumer for %s, subscribing again", queueName)
+    }
+}
+
+func consume(ch *amqp.Channel, queueName string, prefetch int) (<-chan amqp.Delivery, error) {
+    if err := ch.Qos(prefetch, 0, false); err != nil {
+        return nil, err
+    }
+
+    return ch.Consume(queueName, consumerTag, false, false, false, false, nil)
+}
+
+// shardPool returns the pool of workers processing the messages of
+// queueName.
+func (mb *RabbitMessageBroker) shardPool(queueName string) *shardPool {
+    mb.mu.Lock()
+    defer mb.mu.Unlock()
+
+    pool := mb.pools[queueName]
+    if pool == nil {
+        pool = newShardPool()
+        mb.pools[queueName] = pool
+    }
+
+    return pool
+}
+
+// addConsumer registers a consuming channel so Stop can cancel it, it returns
+// false when the broker is already stopping.
+func (mb *RabbitMessageBroker) addConsumer(ch *amqp.Channel) bool {
+    mb.mu.Lock()
+    defer mb.mu.Unlock()
+
+    if mb.stopping || mb.closed {
+        return false
+    }
+    mb.consumers[ch] = true
+
+    return true
 }
 
-func (mb *RabbitMessageBroker) Subscribe(queueName string, subCount int, f func(int) MessageProcessor) error {
-    ch, err := mb.conn.Channel()
+func (mb *RabbitMessageBroker) removeConsumer(ch *amqp.Channel) {
+    mb.mu.Lock()
+    defer mb.mu.Unlock()
+
+    delete(mb.consumers, ch)
+}
+
+// Stop cancels all consumers. Messages already handed to a processor are
+// still processed and settled, after which the Subscribe calls return.
+func (mb *RabbitMessageBroker) Stop() {
+    mb.mu.Lock()
+    mb.stopping = true
+    consumers := make([]*amqp.Channel, 0, len(mb.consumers))
+    for ch := range mb.consumers {
+        consumers = append(consumers, ch)
+    }
+    mb.cond.Broadcast()
+    mb.mu.Unlock()
+
+    for _, ch := range consumers {
+        if err := ch.Cancel(consumerTag, false); err != nil {
+            log.Printf("Stop: error cancelling consumer - %v", err)
+        }
+    }
+}
+
+// ReplayDeadLetters moves the messages dead lettered from queueName back onto
+// it with a fresh attempt count. Only the messages present when the replay
+// starts are moved, so messages failing again are not replayed in a loop.
+func (mb *RabbitMessageBroker) ReplayDeadLetters(queueName string) (int, error) {
+    ch, conn, err := mb.awaitChannel(nil)
     if err != nil {
-        return err
+        return 0, err
     }
     defer ch.Close()
 
-    err = ch.Qos(subCount*3, 0, false)
+    publisher, err := newConfirmPublisher(conn)
     if err != nil {
-        return err
+        return 0, err
     }
+    defer publisher.Close()
 
-    messages, err := ch.Consume(queueName, "processor", false, false, false, false, nil)
+    queue, err := ch.QueueInspect(deadLetterQueueName(queueName))
     if err != nil {
-        return err
+        return 0, err
     }
 
-    var wg sync.WaitGroup
-    wg.Add(subCount)
-    for i := 0; i < subCount; i++ {
-        go func(logProcessorNum int) {
-            defer wg.Done()
+    replayed := 0
+    for replayed < queue.Messages {
+        message, ok, err := ch.Get(queue.Name, false)
+        if err != nil {
+            return replayed, err
+        }
+        if !ok {
+            break
+        }
 
-            processor := f(logProcessorNum)
+        headers := copyHeaders(message.Headers)
+        delete(headers, attemptsHeader)
+        delete(headers, failureReasonHeader)
+        delete(headers, originalQueueHeader)
+        headers[replayedHeader] = true
 
-            for message := range messages {
-                processor.Process(message.Body)
-                message.Ack(false)
-            }
-        }(i)
+        if err = publisher.Publish("", queueName, republishing(message, headers)); err != nil {
+            message.Nack(false, true)
+            return replayed, err
+        }
+
+        if err = message.Ack(false); err != nil {
+            return replayed, err
+        }
+
+        replayed++
     }
-    wg.Wait()
 
-    return nil
+    return replayed, nil
 }
 
-func (mb *RabbitMessageBroker) Close() {
-    mb.conn.Close()
+// deliver processes a message and settles it with the broker. Successful
+// messages are acked, messages failing with a retryable error go through the
+// retry queue back onto their queue until they run out of attempts, and all
+// others are dead lettered. Failing messages are only acked once the broker
+// confirmed their retried or dead lettered copy.
+func deliver(ctx context.Context, publisher *confirmPublisher, queueName string, processor MessageProcessor, message amqp.Delivery) {
+    err := processor.Process(ctx, message.Body)
+    if err == nil {
+        if err = message.Ack(false); err != nil {
+            log.Printf("deliver: error acking message - %v", err)
+        }
+        return
+    }
+
+    attempts := deliveryAttempts(message) + 1
+
+    if processor.Retryable(err) && attempts < maxDeliveryAttempts {
+        log.Printf("deliver: retrying message (attempt %d) - %v", attempts, err)
+        appMetrics.MarkRetriedMessageCount()
+
+        headers := copyHeaders(message.Headers)
+        headers[attemptsHeader] = int32(attempts)
+
+        if err = publisher.Publish("", retryQueueName(queueName), republishing(message, headers)); err != nil {
+            log.Printf("deliver: error republishing message, requeueing - %v", err)
+            message.Nack(false, true)
+            return
+        }
+
+        message.Ack(false)
+        return
+    }
+
+    log.Printf("deliver: dead lettering message after %d attempt(s) - %v", attempts, err)
+    appMetrics.MarkDeadLetteredMessageCount()
+
+    if err = deadLetter(publisher, queueName, message, err, attempts); err != nil {
+        // the queue has no dead letter exchange, a rejected message would be
+        // dropped, so it is requeued to be dead lettered again
+        log.Printf("deliver: error dead lettering message, requeueing - %v", err)
+        message.Nack(false, true)
+        return
+    }
+
+    message.Ack(false)
 }
 
-func NewMessageBroker(url string) (MessageBroker, error) {
-    var err error
+func deadLetter(publisher *confirmPublisher, queueName string, message amqp.Delivery, reason error, attempts int) error {
+    headers := copyHeaders(message.Headers)
+    headers[attemptsHeader] = int32(attempts)
+    headers[failureReasonHeader] = reason.Error()
+    headers[originalQueueHeader] = queueName
 
-    if url == "" {
-        log.Fatal("We Haz No AMQP Deets")
+    return publisher.Publish(deadLetterExchange, queueName, republishing(message, headers))
+}
+
+func republishing(message amqp.Delivery, headers amqp.Table) amqp.Publishing {
+    return amqp.Publishing{
+        Headers:         headers,
+        ContentType:     message.ContentType,
+        ContentEncoding: message.ContentEncoding,
+        DeliveryMode:    amqp.Persistent,
+        Priority:        message.Priority,
+        CorrelationId:   message.CorrelationId,
+        MessageId:       message.MessageId,
+        Timestamp:       message.Timestamp,
+        Type:            message.Type,
+        AppId:           message.AppId,
+        Body:            message.Body,
     }
+}
 
-    conn, err := amqp.Dial(url)
+func copyHeaders(headers amqp.Table) amqp.Table {
+    copied := amqp.Table{}
+    for k, v := range headers {
+        copied[k] = v
+    }
+    return copied
+}
+
+// deliveryAttempts returns how often the message has been processed before.
+func deliveryAttempts(message amqp.Delivery) int {
+    switch v := message.Headers[attemptsHeader].(type) {
+    case int32:
+        return int(v)
+    case int64:
+        return int(v)
+    case int16:
+        return int(v)
+    case int8:
+        return int(v)
+    }
+
+    return 0
+}
+
+func retryQueueName(queueName string) string {
+    return fmt.Sprintf("%s.retry", queueName)
+}
+
+// declareRetryQueue declares the queue retried messages wait in. Once
+// retryDelay is up they expire, and are dead lettered back onto queueName.
+func declareRetryQueue(ch *amqp.Channel, queueName string) error {
+    args := amqp.Table{
+        "x-message-ttl":             int32(retryDelay / time.Millisecond),
+        "x-dead-letter-exchange":    "",
+        "x-dead-letter-routing-key": queueName,
+    }
+
+    _, err := ch.QueueDeclare(retryQueueName(queueName), true, false, false, false, args)
+    return err
+}
+
+func deadLetterQueueName(queueName string) string {
+    return fmt.Sprintf("%s.dead_letter", queueName)
+}
+
+// declareDeadLetterQueue declares the dead letter queue for queueName and
+// binds it to the dead letter exchange using queueName as the routing key.
+func declareDeadLetterQueue(ch *amqp.Channel, queueName string) error {
+    dlq := deadLetterQueueName(queueName)
+
+    if _, err := ch.QueueDeclare(dlq, true, false, false, false, nil); err != nil {
+        return err
+    }
+
+    return ch.QueueBind(dlq, queueName, deadLetterExchange, false, nil)
+}
+
+// awaitChannel opens a channel on the current connection, waiting for the
+// broker to reconnect while it has none or while it is still on the stale
+// connection a previous channel failed on.
+func (mb *RabbitMessageBroker) awaitChannel(stale *amqp.Connection) (*amqp.Channel, *amqp.Connection, error) {
+    mb.mu.Lock()
+    for !mb.closed && !mb.stopping && (mb.conn == nil || mb.conn == stale) {
+        mb.cond.Wait()
+    }
+    if mb.closed || mb.stopping {
+        mb.mu.Unlock()
+        return nil, nil, errBrokerClosed
+    }
+    conn := mb.conn
+    mb.mu.Unlock()
+
+    ch, err := conn.Channel()
     if err != nil {
-        return nil, err
+        return nil, conn, err
+    }
+
+    return ch, conn, nil
+}
+
+func (mb *RabbitMessageBroker) isStopped() bool {
+    mb.mu.Lock()
+    defer mb.mu.Unlock()
+
+    return mb.stopping || mb.closed
+}
+
+func (mb *RabbitMessageBroker) connect() error {
+    conn, err := amqp.Dial(mb.url)
+    if err != nil {
+        return err
+    }
+
+    if err = declareTopology(conn, mb.queueName); err != nil {
+        conn.Close()
+        return err
     }
 
+    mb.mu.Lock()
+    if mb.closed {
+        mb.mu.Unlock()
+        conn.Close()
+        return errBrokerClosed
+    }
+    mb.conn = conn
+    mb.cond.Broadcast()
+    mb.mu.Unlock()
+
+    go mb.watch(conn)
+
+    return nil
+}
+
+// watch waits for conn to close and reconnects unless the broker was closed.
+func (mb *RabbitMessageBroker) watch(conn *amqp.Connection) {
+    amqpErr := <-conn.NotifyClose(make(chan *amqp.Error, 1))
+
+    mb.mu.Lock()
+    if mb.conn == conn {
+        mb.conn = nil
+    }
+    closed := mb.closed
+    mb.mu.Unlock()
+
+    if closed {
+        return
+    }
+
+    log.Printf("AMQP connection lost - %v", amqpErr)
+    appMetrics.MarkAMQPDisconnectCount()
+
+    mb.reconnect()
+}
+
+func (mb *RabbitMessageBroker) reconnect() {
+    for attempt := 1; ; attempt++ {
+        time.Sleep(backoffDelay(attempt, reconnectBaseDelay, reconnectMaxDelay, 0.5))
+
+        err := mb.connect()
+        if err == errBrokerClosed {
+            return
+        }
+        if err != nil {
+            appMetrics.MarkFailedAMQPReconnectCount()
+            log.Printf("reconnect: error reconnecting to AMQP (attempt %d) - %v", attempt, err)
+            continue
+        }
+
+        appMetrics.MarkAMQPReconnectCount()
+        log.Printf("Reconnected to AMQP after %d attempt(s)", attempt)
+        return
+    }
+}
+
+func declareTopology(conn *amqp.Connection, queueName string) error {
     ch, err := conn.Channel()
     if err != nil {
-        return nil, err
+        return err
     }
     defer ch.Close()
 
-    if _, err := ch.QueueDeclare("reporting.jobs.logs", true, false, false, false, nil); err != nil {
-        return nil, err
+    if _, err = ch.QueueDeclare(queueName, true, false, false, false, nil); err != nil {
+        return err
     }
 
     if err = ch.ExchangeDeclare("reporting", "topic", true, false, false, false, nil); err != nil {
+        return err
+    }
+
+    if err = ch.ExchangeDeclare(deadLetterExchange, "direct", true, false, false, false, nil); err != nil {
+        return err
+    }
+
+    if err = declareRetryQueue(ch, queueName); err != nil {
+        return err
+    }
+
+    return declareDeadLetterQueue(ch, queueName)
+}
+
+// Close closes the connection, cancelling the context of messages still being
+// processed.
+func (mb *RabbitMessageBroker) Close() {
+    mb.cancel()
+
+    mb.mu.Lock()
+    mb.closed = true
+    conn := mb.conn
+    mb.cond.Broadcast()
+    mb.mu.Unlock()
+
+    if conn != nil {
+        conn.Close()
+    }
+}
+
+// NewMessageBroker connects to RabbitMQ, declaring queueName along with its
+// dead letter queue.
+func NewMessageBroker(url string, queueName string) (MessageBroker, error) {
+    if url == "" {
+        log.Fatal("We Haz No AMQP Deets")
+    }
+
+    mb := &RabbitMessageBroker{url: url, queueName: queueName, consumers: map[*amqp.Channel]bool{}, pools: map[string]*shardPool{}}
+    mb.ctx, mb.cancel = context.WithCancel(context.Background())
+    mb.cond = sync.NewCond(&mb.mu)
+
+    if err := mb.connect(); err != nil {
         return nil, err
     }
 
-    return &RabbitMessageBroker{conn}, nil
+    return mb, nil
 }
@@ -1,6 +1,8 @@
 package main
 
 import (
+    "database/sql"
+    "fmt"
     "github.com/rcrowley/go-metrics"
     "log"
     "time"
@@ -13,15 +15,74 @@ type Metrics interface {
     MarkFailedPusherCount()
     TimeLogPartProcessing(f func())
     MarkFailedLogPartCount()
+    MarkFailedParseCount()
+    MarkFailedFindLogIdCount()
+    MarkAutoCreatedLogCount()
+    MarkLogIdCacheHit()
+    MarkLogIdCacheMiss()
+    MarkFailedCreateLogPartCount()
+    MarkDuplicateLogPartCount()
+    TimeLogPartBatchFlush(size int, f func())
+    MarkStageAttempt(stage string, attempt int)
+    MarkRetriedMessageCount()
+    MarkDeadLetteredMessageCount()
+    MarkAMQPDisconnectCount()
+    MarkAMQPReconnectCount()
+    MarkFailedAMQPReconnectCount()
+    UpdateDBPoolStats(stats sql.DBStats)
+    TimeLogAggregation(f func())
+    MarkFailedLogAggregationCount()
+    MarkOversizePusherEventCount()
+    MarkCoalescedPusherEventCount(parts int)
+    MarkVacantPusherChannelCount()
+    MarkShortCircuitedPusherCount()
+    UpdatePusherBreakerState(state int)
+    UpdatePusherQueueDepth(depth int64)
+    MarkDroppedPusherQueueCount()
+    MarkLogPartSequence(event string)
+    MarkHeldReorderCount()
+    MarkExpiredReorderCount()
+    MarkTimedOutPusherCount()
     StartLogging()
     EachMetric(func(string, interface{}))
 }
 type LiveMetrics struct {
-    Registry           metrics.Registry
-    ProcessTimer       metrics.Timer
-    ProcessFailedCount metrics.Meter
-    PusherTimer        metrics.Timer
-    PusherFailedCount  metrics.Meter
+    Registry                  metrics.Registry
+    ProcessTimer              metrics.Timer
+    ProcessFailedCount        metrics.Meter
+    ParseFailedCount          metrics.Meter
+    FindLogIdFailedCount      metrics.Meter
+    AutoCreatedLogCount       metrics.Meter
+    LogIdCacheHitCount        metrics.Meter
+    LogIdCacheMissCount       metrics.Meter
+    CreateLogPartFailedCount  metrics.Meter
+    DuplicateLogPartCount     metrics.Meter
+    BatchFlushTimer           metrics.Timer
+    BatchFlushSize            metrics.Histogram
+    PusherTimer               metrics.Timer
+    PusherFailedCount         metrics.Meter
+    RetriedCount              metrics.Meter
+    DeadLetteredCount         metrics.Meter
+    AMQPDisconnectCount       metrics.Meter
+    AMQPReconnectCount        metrics.Meter
+    AMQPReconnectFailedCount  metrics.Meter
+    DBPoolOpen                metrics.Gauge
+    DBPoolInUse               metrics.Gauge
+    DBPoolIdle                metrics.Gauge
+    DBPoolWaitCount           metrics.Gauge
+    DBPoolWaitDuration        metrics.Gauge
+    AggregateTimer            metrics.Timer
+    AggregateFailedCount      metrics.Meter
+    PusherOversizeCount       metrics.Meter
+    PusherCoalescedCount      metrics.Meter
+    PusherVacantCount         metrics.Meter
+    PusherShortCircuitedCount metrics.Meter
+    PusherBreakerState        metrics.Gauge
+    PusherQueueDepth          metrics.Gauge
+    PusherQueueDroppedCount   metrics.Meter
+    ReorderHeldCount          metrics.Meter
+    ReorderExpiredCount       metrics.Meter
+    PusherTimedOutCount       metrics.Meter
 }
 
 var _ Metrics = &LiveMetrics{}
@@ -35,13 +96,151 @@ func NewMetrics() Metrics {
     processFailedCount := metrics.NewMeter()
     registry.Register("logs.process_log_part.failed", processFailedCount)
 
+    parseFailedCount := metrics.NewMeter()
+    registry.Register("logs.process_log_part.parse.failed", parseFailedCount)
+
+    findLogIdFailedCount := metrics.NewMeter()
+    registry.Register("logs.process_log_part.find_log_id.failed", findLogIdFailedCount)
+
+    autoCreatedLogCount := metrics.NewMeter()
+    registry.Register("logs.process_log_part.find_log_id.created", autoCreatedLogCount)
+
+    logIdCacheHitCount := metrics.NewMeter()
+    registry.Register("logs.process_log_part.find_log_id.cache.hit", logIdCacheHitCount)
+
+    logIdCacheMissCount := metrics.NewMeter()
+    registry.Register("logs.process_log_part.find_log_id.cache.miss", logIdCacheMissCount)
+
+    createLogPartFailedCount := metrics.NewMeter()
+    registry.Register("logs.process_log_part.create_log_part.failed", createLogPartFailedCount)
+
+    duplicateLogPartCount := metrics.NewMeter()
+    registry.Register("logs.process_log_part.create_log_part.duplicate", duplicateLogPartCount)
+
+    batchFlushTimer := metrics.NewTimer()
+    registry.Register("logs.create_log_parts.flush", batchFlushTimer)
+
+    batchFlushSize := metrics.NewHistogram(metrics.NewExpDecaySample(1028, 0.015))
+    registry.Register("logs.create_log_parts.flush.size", batchFlushSize)
+
     pusherTimer := metrics.NewTimer()
     registry.Register("logs.process_log_part.pusher", pusherTimer)
 
     pusherFailedCount := metrics.NewMeter()
     registry.Register("logs.process_log_part.pusher.failed", pusherFailedCount)
 
-    return &LiveMetrics{registry, processTimer, processFailedCount, pusherTimer, pusherFailedCount}
+    retriedCount := metrics.NewMeter()
+    registry.Register("logs.process_log_part.retried", retriedCount)
+
+    deadLetteredCount := metrics.NewMeter()
+    registry.Register("logs.process_log_part.dead_lettered", deadLetteredCount)
+
+    amqpDisconnectCount := metrics.NewMeter()
+    registry.Register("logs.amqp.disconnects", amqpDisconnectCount)
+
+    amqpReconnectCount := metrics.NewMeter()
+    registry.Register("logs.amqp.reconnects", amqpReconnectCount)
+
+    amqpReconnectFailedCount := metrics.NewMeter()
+    registry.Register("logs.amqp.reconnects.failed", amqpReconnectFailedCount)
+
+    dbPoolOpen := metrics.NewGauge()
+    registry.Register("logs.db.pool.open", dbPoolOpen)
+
+    dbPoolInUse := metrics.NewGauge()
+    registry.Register("logs.db.pool.in_use", dbPoolInUse)
+
+    dbPoolIdle := metrics.NewGauge()
+    registry.Register("logs.db.pool.idle", dbPoolIdle)
+
+    dbPoolWaitCount := metrics.NewGauge()
+    registry.Register("logs.db.pool.wait_count", dbPoolWaitCount)
+
+    dbPoolWaitDuration := metrics.NewGauge()
+    registry.Register("logs.db.pool.wait_duration_ms", dbPoolWaitDuration)
+
+    aggregateTimer := metrics.NewTimer()
+    registry.Register("logs.aggregate_log", aggregateTimer)
+
+    aggregateFailedCount := metrics.NewMeter()
+    registry.Register("logs.aggregate_log.failed", aggregateFailedCount)
+
+    pusherOversizeCount := metrics.NewMeter()
+    registry.Register("logs.process_log_part.pusher.oversize", pusherOversizeCount)
+
+    pusherCoalescedCount := metrics.NewMeter()
+    registry.Register("logs.process_log_part.pusher.coalesced", pusherCoalescedCount)
+
+    pusherVacantCount := metrics.NewMeter()
+    registry.Register("logs.process_log_part.pusher.vacant", pusherVacantCount)
+
+    pusherShortCircuitedCount := metrics.NewMeter()
+    registry.Register("logs.process_log_part.pusher.short_circuited", pusherShortCircuitedCount)
+
+    pusherBreakerState := metrics.NewGauge()
+    registry.Register("logs.pusher.breaker.state", pusherBreakerState)
+
+    registry.Register("logs.pusher.breaker", metrics.NewHealthcheck(func(h metrics.Healthcheck) {
+        if pusherBreakerState.Value() == breakerOpen {
+            h.Unhealthy(errCircuitOpen)
+        } else {
+            h.Healthy()
+        }
+    }))
+
+    pusherQueueDepth := metrics.NewGauge()
+    registry.Register("logs.pusher.queue.depth", pusherQueueDepth)
+
+    pusherQueueDroppedCount := metrics.NewMeter()
+    registry.Register("logs.pusher.queue.dropped", pusherQueueDroppedCount)
+
+    reorderHeldCount := metrics.NewMeter()
+    registry.Register("logs.pusher.reorder.held", reorderHeldCount)
+
+    reorderExpiredCount := metrics.NewMeter()
+    registry.Register("logs.pusher.reorder.expired", reorderExpiredCount)
+
+    pusherTimedOutCount := metrics.NewMeter()
+    registry.Register("logs.process_log_part.pusher.timed_out", pusherTimedOutCount)
+
+    return &LiveMetrics{
+        Registry:                  registry,
+        ProcessTimer:              processTimer,
+        ProcessFailedCount:        processFailedCount,
+        ParseFailedCount:          parseFailedCount,
+        FindLogIdFailedCount:      findLogIdFailedCount,
+        AutoCreatedLogCount:       autoCreatedLogCount,
+        LogIdCacheHitCount:        logIdCacheHitCount,
+        LogIdCacheMissCount:       logIdCacheMissCount,
+        CreateLogPartFailedCount:  createLogPartFailedCount,
+        DuplicateLogPartCount:     duplicateLogPartCount,
+        BatchFlushTimer:           batchFlushTimer,
+        BatchFlushSize:            batchFlushSize,
+        PusherTimer:               pusherTimer,
+        PusherFailedCount:         pusherFailedCount,
+        RetriedCount:              retriedCount,
+        DeadLetteredCount:         deadLetteredCount,
+        AMQPDisconnectCount:       amqpDisconnectCount,
+        AMQPReconnectCount:        amqpReconnectCount,
+        AMQPReconnectFailedCount:  amqpReconnectFailedCount,
+        DBPoolOpen:                dbPoolOpen,
+        DBPoolInUse:               dbPoolInUse,
+        DBPoolIdle:                dbPoolIdle,
+        DBPoolWaitCount:           dbPoolWaitCount,
+        DBPoolWaitDuration:        dbPoolWaitDuration,
+        AggregateTimer:            aggregateTimer,
+        AggregateFailedCount:      aggregateFailedCount,
+        PusherOversizeCount:       pusherOversizeCount,
+        PusherCoalescedCount:      pusherCoalescedCount,
+        PusherVacantCount:         pusherVacantCount,
+        PusherShortCircuitedCount: pusherShortCircuitedCount,
+        PusherBreakerState:        pusherBreakerState,
+        PusherQueueDepth:          pusherQueueDepth,
+        PusherQueueDroppedCount:   pusherQueueDroppedCount,
+        ReorderHeldCount:          reorderHeldCount,
+        ReorderExpiredCount:       reorderExpiredCount,
+        PusherTimedOutCount:       pusherTimedOutCount,
+    }
 }
 
 func (m *LiveMetrics) TimePusher(f func()) {
@@ -60,6 +259,135 @@ func (m *LiveMetrics) MarkFailedLogPartCount() {
     m.ProcessFailedCount.Mark(1)
 }
 
+func (m *LiveMetrics) MarkFailedParseCount() {
+    m.ParseFailedCount.Mark(1)
+}
+
+func (m *LiveMetrics) MarkFailedFindLogIdCount() {
+    m.FindLogIdFailedCount.Mark(1)
+}
+
+func (m *LiveMetrics) MarkAutoCreatedLogCount() {
+    m.AutoCreatedLogCount.Mark(1)
+}
+
+func (m *LiveMetrics) MarkLogIdCacheHit() {
+    m.LogIdCacheHitCount.Mark(1)
+}
+
+func (m *LiveMetrics) MarkLogIdCacheMiss() {
+    m.LogIdCacheMissCount.Mark(1)
+}
+
+func (m *LiveMetrics) MarkFailedCreateLogPartCount() {
+    m.CreateLogPartFailedCount.Mark(1)
+}
+
+func (m *LiveMetrics) MarkDuplicateLogPartCount() {
+    m.DuplicateLogPartCount.Mark(1)
+}
+
+func (m *LiveMetrics) TimeLogPartBatchFlush(size int, f func()) {
+    m.BatchFlushSize.Update(int64(size))
+    m.BatchFlushTimer.Time(f)
+}
+
+// MarkStageAttempt records an attempt at a processing stage, attempts after
+// the first are also recorded as retries.
+func (m *LiveMetrics) MarkStageAttempt(stage string, attempt int) {
+    metrics.GetOrRegisterMeter(fmt.Sprintf("logs.process_log_part.%s.attempts", stage), m.Registry).Mark(1)
+
+    if attempt > 1 {
+        metrics.GetOrRegisterMeter(fmt.Sprintf("logs.process_log_part.%s.retries", stage), m.Registry).Mark(1)
+    }
+}
+
+func (m *LiveMetrics) MarkRetriedMessageCount() {
+    m.RetriedCount.Mark(1)
+}
+
+func (m *LiveMetrics) MarkDeadLetteredMessageCount() {
+    m.DeadLetteredCount.Mark(1)
+}
+
+func (m *LiveMetrics) MarkAMQPDisconnectCount() {
+    m.AMQPDisconnectCount.Mark(1)
+}
+
+func (m *LiveMetrics) MarkAMQPReconnectCount() {
+    m.AMQPReconnectCount.Mark(1)
+}
+
+func (m *LiveMetrics) MarkFailedAMQPReconnectCount() {
+    m.AMQPReconnectFailedCount.Mark(1)
+}
+
+func (m *LiveMetrics) UpdateDBPoolStats(stats sql.DBStats) {
+    m.DBPoolOpen.Update(int64(stats.OpenConnections))
+    m.DBPoolInUse.Update(int64(stats.InUse))
+    m.DBPoolIdle.Update(int64(stats.Idle))
+    m.DBPoolWaitCount.Update(stats.WaitCount)
+    m.DBPoolWaitDuration.Update(int64(stats.WaitDuration / time.Millisecond))
+}
+
+func (m *LiveMetrics) TimeLogAggregation(f func()) {
+    m.AggregateTimer.Time(f)
+}
+
+func (m *LiveMetrics) MarkFailedLogAggregationCount() {
+    m.AggregateFailedCount.Mark(1)
+}
+
+func (m *LiveMetrics) MarkOversizePusherEventCount() {
+    m.PusherOversizeCount.Mark(1)
+}
+
+// MarkCoalescedPusherEventCount records the Pusher events saved by merging
+// parts log parts into one.
+func (m *LiveMetrics) MarkCoalescedPusherEventCount(parts int) {
+    m.PusherCoalescedCount.Mark(int64(parts - 1))
+}
+
+func (m *LiveMetrics) MarkVacantPusherChannelCount() {
+    m.PusherVacantCount.Mark(1)
+}
+
+func (m *LiveMetrics) MarkShortCircuitedPusherCount() {
+    m.PusherShortCircuitedCount.Mark(1)
+}
+
+// UpdatePusherBreakerState records the state of the Pusher circuit breaker:
+// 0 closed, 1 half-open and 2 open.
+func (m *LiveMetrics) UpdatePusherBreakerState(state int) {
+    m.PusherBreakerState.Update(int64(state))
+}
+
+func (m *LiveMetrics) UpdatePusherQueueDepth(depth int64) {
+    m.PusherQueueDepth.Update(depth)
+}
+
+func (m *LiveMetrics) MarkDroppedPusherQueueCount() {
+    m.PusherQueueDroppedCount.Mark(1)
+}
+
+// MarkLogPartSequence records an irregularity in the numbers of the log
+// parts of a job, such as a gap or a duplicate.
+func (m *LiveMetrics) MarkLogPartSequence(event string) {
+    metrics.GetOrRegisterMeter(fmt.Sprintf("logs.process_log_part.sequence.%s", event), m.Registry).Mark(1)
+}
+
+func (m *LiveMetrics) MarkHeldReorderCount() {
+    m.ReorderHeldCount.Mark(1)
+}
+
+func (m *LiveMetrics) MarkExpiredReorderCount() {
+    m.ReorderExpiredCount.Mark(1)
+}
+
+func (m *LiveMetrics) MarkTimedOutPusherCount() {
+    m.PusherTimedOutCount.Mark(1)
+}
+
 func (m *LiveMetrics) StartLogging() {
     go func() {
         for _ = range time.Tick(time.Duration(60) * time.Second) {
@@ -85,7 +413,7 @@ func logMetrics(m Metrics) {
             log.Printf("metriks: time=%d name=%s type=healthcheck error=%v\n", now, name, m.Error())
         case metrics.Histogram:
             ps := m.Percentiles([]float64{0.5, 0.75, 0.95, 0.99, 0.999})
-            log.Printf("metriks: time=%d name=%s type=histogram count=%d min=%d max=%d mean=%f stddev=%f median=%f 95th_percentile=%f 99th_percentile=%f\n", now, name, m.Count(), int64NanoToSeconds(m.Min()), int64NanoToSeconds(m.Max()), float64NanoToSeconds(m.Mean()), float64NanoToSeconds(m.StdDev()), float64NanoToSeconds(ps[0]), float64NanoToSeconds(ps[2]), float64NanoToSeconds(ps[3]))
+            log.Printf("metriks: time=%d name=%s type=histogram count=%d min=%d max=%d mean=%f stddev=%f median=%f 95th_percentile=%f 99th_percentile=%f\n", now, name, m.Count(), m.Min(), m.Max(), m.Mean(), m.StdDev(), ps[0], ps[2], ps[3])
         case metrics.Meter:
             log.Printf("metriks: time=%d name=%s type=meter count=%d one_minute_rate=%f five_minute_rate=%f fifteen_minute_rate=%f mean_rate=%f\n", now, name, m.Count(), m.Rate1(), m.Rate5(), m.Rate15(), m.RateMean())
         case metrics.Timer:
@@ -0,0 +1,325 @@
+package main
+
+import (
+    "context"
+    "database/sql"
+    "fmt"
+    "time"
+)
+
+// Migration is a schema change. Its statements run in a single transaction,
+// unless NoTransaction is set for statements which can't, such as CREATE
+// INDEX CONCURRENTLY.
+type Migration struct {
+    Version       int
+    Name          string
+    Up            []string
+    Down          []string
+    NoTransaction bool
+}
+
+// baselineVersion is the schema the service was deployed with before it had
+// migrations, `migrate baseline` marks existing databases as being at it.
+const baselineVersion = 1
+
+// migrations are applied in order and recorded in schema_migrations. Once a
+// migration has been deployed it must not be changed, add a new one instead.
+var migrations = []Migration{
+    {
+        Version: baselineVersion,
+        Name:    "baseline",
+        Up: []string{
+            `CREATE TABLE logs (
+                id serial PRIMARY KEY,
+                job_id integer,
+                content text,
+                aggregated_at timestamp without time zone,
+                created_at timestamp without time zone,
+                updated_at timestamp without time zone
+            )`,
+            `CREATE INDEX index_logs_on_job_id ON logs (job_id)`,
+            `CREATE TABLE log_parts (
+                id serial PRIMARY KEY,
+                log_id integer NOT NULL,
+                number integer,
+                content text,
+                final boolean,
+                created_at timestamp without time zone
+            )`,
+            `CREATE INDEX index_log_parts_on_log_id_and_number ON log_parts (log_id, number)`,
+        },
+        Down: []string{`DROP TABLE log_parts`, `DROP TABLE logs`},
+    },
+    {
+        Version: 2,
+        Name:    "index_final_log_parts",
+        Up: []string{
+            // a failed concurrent build leaves an invalid index behind
+            `DROP INDEX CONCURRENTLY IF EXISTS index_log_parts_on_log_id_where_final`,
+            `CREATE INDEX CONCURRENTLY index_log_parts_on_log_id_where_final ON log_parts (log_id) WHERE final = true`,
+        },
+        Down:          []string{`DROP INDEX CONCURRENTLY IF EXISTS index_log_parts_on_log_id_where_final`},
+        NoTransaction: true,
+    },
+    {
+        Version: 3,
+        Name:    "unique_logs_job_id",
+        Up: []string{
+            // racing creators left empty duplicates behind, keep the log
+            // holding content or parts, or else the oldest one. Jobs with
+            // several logs holding content have to be merged by hand.
+            `DELETE FROM logs l
+                WHERE COALESCE(l.content, '') = ''
+                AND NOT EXISTS (SELECT 1 FROM log_parts p WHERE p.log_id = l.id)
+                AND EXISTS (
+                    SELECT 1 FROM logs o
+                    WHERE o.job_id = l.job_id AND o.id <> l.id
+                    AND (o.id < l.id OR COALESCE(o.content, '') <> '' OR EXISTS (SELECT 1 FROM log_parts p WHERE p.log_id = o.id))
+                )`,
+            `DROP INDEX CONCURRENTLY IF EXISTS index_logs_on_job_id_unique`,
+            `CREATE UNIQUE INDEX CONCURRENTLY index_logs_on_job_id_unique ON logs (job_id)`,
+        },
+        Down:          []string{`DROP INDEX CONCURRENTLY IF EXISTS index_logs_on_job_id_unique`},
+        NoTransaction: true,
+    },
+    {
+        Version: 4,
+        Name:    "unique_log_parts_log_id_and_number",
+        Up: []string{
+            // redeliveries stored parts twice, keep the first copy. Writers
+            // still running without ON CONFLICT can add duplicates until the
+            // index exists, in which case the migration fails and is rerun.
+            `DELETE FROM log_parts p USING log_parts o
+                WHERE o.log_id = p.log_id AND o.number = p.number AND o.id < p.id`,
+            `DROP INDEX CONCURRENTLY IF EXISTS index_log_parts_on_log_id_and_number_unique`,
+            `CREATE UNIQUE INDEX CONCURRENTLY index_log_parts_on_log_id_and_number_unique ON log_parts (log_id, number)`,
+            `DROP INDEX CONCURRENTLY IF EXISTS index_log_parts_on_log_id_and_number`,
+        },
+        Down: []string{
+            `CREATE INDEX CONCURRENTLY IF NOT EXISTS index_log_parts_on_log_id_and_number ON log_parts (log_id, number)`,
+            `DROP INDEX CONCURRENTLY IF EXISTS index_log_parts_on_log_id_and_number_unique`,
+        },
+        NoTransaction: true,
+    },
+    {
+        // aggregated parts are kept without their content, so that a
+        // redelivered part still conflicts and isn't aggregated twice
+        Version: 5,
+        Name:    "add_log_parts_aggregated_at",
+        Up:      []string{`ALTER TABLE log_parts ADD COLUMN aggregated_at timestamp without time zone`},
+        Down:    []string{`ALTER TABLE log_parts DROP COLUMN aggregated_at`},
+    },
+    {
+        Version: 6,
+        Name:    "index_pending_log_parts",
+        Up: []string{
+            `DROP INDEX CONCURRENTLY IF EXISTS index_log_parts_on_id_where_pending`,
+            `CREATE INDEX CONCURRENTLY index_log_parts_on_id_where_pending ON log_parts (id) WHERE aggregated_at IS NULL`,
+        },
+        Down:          []string{`DROP INDEX CONCURRENTLY IF EXISTS index_log_parts_on_id_where_pending`},
+        NoTransaction: true,
+    },
+}
+
+type migrationStatus struct {
+    Migration
+    AppliedAt *time.Time
+}
+
+func ensureSchemaMigrations(ctx context.Context, db *sql.DB) error {
+    _, err := db.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS schema_migrations (version integer PRIMARY KEY, applied_at timestamp without time zone NOT NULL)")
+    return err
+}
+
+// migrationStatuses returns all migrations along with when they were applied.
+func migrationStatuses(ctx context.Context, db *sql.DB) ([]migrationStatus, error) {
+    if err := ensureSchemaMigrations(ctx, db); err != nil {
+        return nil, err
+    }
+
+    rows, err := db.QueryContext(ctx, "SELECT version, applied_at FROM schema_migrations")
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    applied := map[int]time.Time{}
+    for rows.Next() {
+        var version int
+        var appliedAt time.Time
+        if err = rows.Scan(&version, &appliedAt); err != nil {
+            return nil, err
+        }
+        applied[version] = appliedAt
+    }
+
+    if err = rows.Err(); err != nil {
+        return nil, err
+    }
+
+    statuses := make([]migrationStatus, len(migrations))
+    for i, migration := range migrations {
+        statuses[i].Migration = migration
+        if appliedAt, ok := applied[migration.Version]; ok {
+            statuses[i].AppliedAt = &appliedAt
+        }
+    }
+
+    return statuses, nil
+}
+
+// withMigrationLock runs f holding a session level advisory lock, so that
+// concurrent deploys don't apply the same migrations twice.
+func withMigrationLock(ctx context.Context, db *sql.DB, f func() error) error {
+    conn, err := db.Conn(ctx)
+    if err != nil {
+        return err
+    }
+    defer conn.Close()
+
+    if _, err = conn.ExecContext(ctx, "SELECT pg_advisory_lock(hashtext('schema_migrations'))"); err != nil {
+        return err
+    }
+    defer conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock(hashtext('schema_migrations'))")
+
+    return f()
+}
+
+// migrateUp applies all pending migrations and returns the applied ones.
+func migrateUp(ctx context.Context, db *sql.DB) ([]Migration, error) {
+    applied := []Migration{}
+
+    err := withMigrationLock(ctx, db, func() error {
+        statuses, err := migrationStatuses(ctx, db)
+        if err != nil {
+            return err
+        }
+
+        for _, status := range statuses {
+            if status.AppliedAt != nil {
+                continue
+            }
+
+            err = runMigration(ctx, db, status.Migration, status.Up, "INSERT INTO schema_migrations (version, applied_at) VALUES ($1, $2)", status.Version, time.Now())
+            if err != nil {
+                return fmt.Errorf("migrateUp: migration %d_%s failed: %v", status.Version, status.Name, err)
+            }
+
+            applied = append(applied, status.Migration)
+        }
+
+        return nil
+    })
+
+    return applied, err
+}
+
+// migrateDown reverts the latest applied migration, it returns nil when there
+// was nothing to revert.
+func migrateDown(ctx context.Context, db *sql.DB) (*Migration, error) {
+    var reverted *Migration
+
+    err := withMigrationLock(ctx, db, func() error {
+        statuses, err := migrationStatuses(ctx, db)
+        if err != nil {
+            return err
+        }
+
+        for i := len(statuses) - 1; i >= 0; i-- {
+            status := statuses[i]
+            if status.AppliedAt == nil {
+                continue
+            }
+
+            err = runMigration(ctx, db, status.Migration, status.Down, "DELETE FROM schema_migrations WHERE version = $1", status.Version)
+            if err != nil {
+                return fmt.Errorf("migrateDown: migration %d_%s failed: %v", status.Version, status.Name, err)
+            }
+
+            reverted = &status.Migration
+            return nil
+        }
+
+        return nil
+    })
+
+    return reverted, err
+}
+
+// migrateBaseline records the baseline migration as applied without running
+// it, for databases created before there were migrations.
+func migrateBaseline(ctx context.Context, db *sql.DB) error {
+    return withMigrationLock(ctx, db, func() error {
+        statuses, err := migrationStatuses(ctx, db)
+        if err != nil {
+            return err
+        }
+
+        for _, status := range statuses {
+            if status.AppliedAt != nil {
+                return fmt.Errorf("migrateBaseline: migration %d_%s is already applied", status.Version, status.Name)
+            }
+        }
+
+        _, err = db.ExecContext(ctx, "INSERT INTO schema_migrations (version, applied_at) VALUES ($1, $2)", baselineVersion, time.Now())
+        return err
+    })
+}
+
+// checkMigrations returns an error naming the first pending migration, the
+// queries of the service rely on all of them being applied.
+func checkMigrations(ctx context.Context, db *sql.DB) error {
+    var exists bool
+    if err := db.QueryRowContext(ctx, "SELECT to_regclass('schema_migrations') IS NOT NULL").Scan(&exists); err != nil {
+        return err
+    }
+
+    if !exists {
+        return fmt.Errorf("schema_migrations is missing, run the migrate process first")
+    }
+
+    statuses, err := migrationStatuses(ctx, db)
+    if err != nil {
+        return err
+    }
+
+    for _, status := range statuses {
+        if status.AppliedAt == nil {
+            return fmt.Errorf("migration %d_%s is pending, run the migrate process first", status.Version, status.Name)
+        }
+    }
+
+    return nil
+}
+
+func runMigration(ctx context.Context, db *sql.DB, migration Migration, statements []string, recordSql string, args ...interface{}) error {
+    if migration.NoTransaction {
+        for _, statement := range statements {
+            if _, err := db.ExecContext(ctx, statement); err != nil {
+                return err
+            }
+        }
+
+        _, err := db.ExecContext(ctx, recordSql, args...)
+        return err
+    }
+
+    tx, err := db.BeginTx(ctx, nil)
+    if err != nil {
+        return err
+    }
+
+    for _, statement := range statements {
+        if _, err = tx.ExecContext(ctx, statement); err != nil {
+            tx.Rollback()
+            return err
+        }
+    }
+
+    if _, err = tx.ExecContext(ctx, recordSql, args...); err != nil {
+        tx.Rollback()
+        return err
+    }
+
+    return tx.Commit()
+}
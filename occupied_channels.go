@@ -0,0 +1,64 @@
+package main
+
+import (
+    "github.com/timonv/pusher"
+    "log"
+    "sync"
+    "time"
+)
+
+// OccupiedChannels is the set of job channels with subscribers, as last
+// fetched from Pusher. It fails open: every channel counts as occupied until
+// the set is first fetched, and again once it is older than three intervals.
+type OccupiedChannels struct {
+    interval  time.Duration
+    mu        sync.RWMutex
+    channels  map[string]bool
+    updatedAt time.Time
+}
+
+func NewOccupiedChannels(interval time.Duration) *OccupiedChannels {
+    return &OccupiedChannels{interval: interval}
+}
+
+func (oc *OccupiedChannels) Occupied(channel string) bool {
+    oc.mu.RLock()
+    defer oc.mu.RUnlock()
+
+    if time.Since(oc.updatedAt) > 3*oc.interval {
+        return true
+    }
+
+    return oc.channels[channel]
+}
+
+// Track fetches the occupied channels every interval, forever.
+func (oc *OccupiedChannels) Track(client *pusher.Client) {
+    for {
+        if err := oc.refresh(client); err != nil {
+            log.Printf("Track: error fetching the occupied Pusher channels - %v", err)
+        }
+
+        time.Sleep(oc.interval)
+    }
+}
+
+func (oc *OccupiedChannels) refresh(client *pusher.Client) error {
+    list, err := client.Channels(map[string]string{"filter_by_prefix": "job-"})
+    if err != nil {
+        return err
+    }
+
+    channels := make(map[string]bool, len(list.List))
+    for channel := range list.List {
+        channels[channel] = true
+    }
+
+    oc.mu.Lock()
+    defer oc.mu.Unlock()
+
+    oc.channels = channels
+    oc.updatedAt = time.Now()
+
+    return nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+    "context"
+    "database/sql"
+    "encoding/json"
+    "fmt"
+    "github.com/lib/pq"
+    "log"
+    "time"
+)
+
+const (
+    // logNotifyChannel is the Postgres channel log parts are announced on.
+    logNotifyChannel = "job_log"
+
+    // pgNotifyMaxPayload is the largest NOTIFY payload Postgres accepts,
+    // larger log parts are split into chunks like Pusher events.
+    pgNotifyMaxPayload = 7999
+
+    // postgresHubConns is how many connections notifications are sent on.
+    postgresHubConns = 4
+)
+
+// PostgresHub is a Pusher fanning log parts out to the subscribers of every
+// process, through Postgres LISTEN/NOTIFY. Publishing notifies the job_log
+// channel, and the notifications received, including the process' own, are
+// handed to the subscribers of its LocalHub.
+type PostgresHub struct {
+    *LocalHub
+    db       *sql.DB
+    notify   *sql.Stmt
+    listener *pq.Listener
+}
+
+func NewPostgresHub(url string) (*PostgresHub, error) {
+    db, err := openDatabase(url, PoolConfig{postgresHubConns, postgresHubConns, 0})
+    if err != nil {
+        return nil, err
+    }
+
+    notify, err := db.Prepare("SELECT pg_notify($1, $2)")
+    if err != nil {
+        db.Close()
+        return nil, err
+    }
+
+    listener := pq.NewListener(url, time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+        if err != nil {
+            log.Printf("NewPostgresHub: listener connection event %d - %v", event, err)
+        }
+    })
+
+    if err = listener.Listen(logNotifyChannel); err != nil {
+        listener.Close()
+        db.Close()
+        return nil, err
+    }
+
+    h := &PostgresHub{NewLocalHub(), db, notify, listener}
+    go h.receive()
+
+    return h, nil
+}
+
+func (h *PostgresHub) Publish(ctx context.Context, jobId int, number int, content string, final bool) error {
+    payload := PusherPayload{
+        JobId:   jobId,
+        Number:  number,
+        Content: content,
+        Final:   final,
+    }
+
+    payloads, err := splitPusherPayload(payload, pgNotifyMaxPayload)
+    if err != nil {
+        return err
+    }
+
+    for i, payload := range payloads {
+        jsonPayload, err := json.Marshal(&payload)
+        if err != nil {
+            return fmt.Errorf("Publish: error during json.marshal: %v", err)
+        }
+
+        if _, err = h.notify.ExecContext(ctx, logNotifyChannel, string(jsonPayload)); err != nil {
+            // like with Pusher, the chunks which went out are not sent again
+            if i > 0 {
+                return &PusherPublishError{err, false}
+            }
+            return &DBError{"Publish", err}
+        }
+    }
+
+    return nil
+}
+
+// receive hands the notifications to the local subscribers until the
+// listener is closed.
+func (h *PostgresHub) receive() {
+    for notification := range h.listener.NotificationChannel() {
+        // a nil notification follows a reconnect, notifications sent while
+        // disconnected are lost
+        if notification == nil {
+            log.Println("receive: reconnected to Postgres, live log parts may have been missed")
+            continue
+        }
+
+        var payload PusherPayload
+        if err := json.Unmarshal([]byte(notification.Extra), &payload); err != nil {
+            log.Printf("receive: error during json.unmarshal - %v", err)
+            continue
+        }
+
+        h.LocalHub.PublishPayload(payload)
+    }
+}
+
+func (h *PostgresHub) Close() {
+    h.listener.Close()
+    h.db.Close()
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+    "context"
+    "log"
+    "os"
+    "time"
+)
+
+func startLogAggregation() {
+    log.Println("Starting Log Aggregation")
+
+    db, err := NewRealDB(os.Getenv("DATABASE_URL"), dbPoolConfig())
+    if err != nil {
+        log.Fatalf("startLogAggregation: fatal error connecting to the database - %v", err)
+    }
+    defer db.Close()
+
+    appMetrics.StartLogging()
+
+    failed := failedAggregations{}
+
+    for {
+        count, err := aggregateLogs(db, *aggregateBatchSize, *aggregateGracePeriod, failed)
+        if err != nil {
+            log.Printf("startLogAggregation: error finding logs to aggregate - %v", err)
+        }
+
+        if count == 0 {
+            time.Sleep(*aggregateInterval)
+        }
+    }
+}
+
+// aggregateLogs aggregates up to limit logs which have received their final
+// log part at least the grace period ago, returning how many were
+// aggregated. Logs which failed recently are skipped.
+func aggregateLogs(db DB, limit int, grace time.Duration, failed failedAggregations) (int, error) {
+    now := time.Now()
+
+    logIds, err := db.FindAggregatableLogIds(context.Background(), limit, failed.held(now), now.Add(-grace))
+    if err != nil {
+        return 0, err
+    }
+
+    count := 0
+    for _, logId := range logIds {
+        appMetrics.TimeLogAggregation(func() {
+            err = db.AggregateLog(context.Background(), logId)
+        })
+
+        if err != nil {
+            appMetrics.MarkFailedLogAggregationCount()
+            retryAt := failed.fail(logId, time.Now())
+            log.Printf("aggregateLogs: error aggregating logId:%d, retrying after %s - %v", logId, retryAt.Format(time.RFC3339), err)
+            continue
+        }
+
+        delete(failed, logId)
+        count++
+    }
+
+    return count, nil
+}
+
+// failedAggregations holds back logs which failed to aggregate, for longer
+// with every failure, so that logs failing every time don't take up the
+// batches.
+type failedAggregations map[int]*failedAggregation
+
+type failedAggregation struct {
+    failures int
+    retryAt  time.Time
+}
+
+// held returns the logs not to be retried yet, and forgets the logs which
+// haven't been retried an hour after they could have been.
+func (f failedAggregations) held(now time.Time) []int {
+    logIds := []int{}
+    for logId, failure := range f {
+        switch {
+        case now.Before(failure.retryAt):
+            logIds = append(logIds, logId)
+        case now.Sub(failure.retryAt) > time.Hour:
+            delete(f, logId)
+        }
+    }
+    return logIds
+}
+
+func (f failedAggregations) fail(logId int, now time.Time) time.Time {
+    failure := f[logId]
+    if failure == nil {
+        failure = &failedAggregation{}
+        f[logId] = failure
+    }
+
+    failure.failures++
+    failure.retryAt = now.Add(backoffDelay(failure.failures, *aggregateInterval, time.Hour, 0.2))
+
+    return failure.retryAt
+}
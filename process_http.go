@@ -0,0 +1,62 @@
+package main
+
+import (
+    "context"
+    "log"
+    "net/http"
+    "os"
+    "os/signal"
+    "syscall"
+)
+
+func startHTTPServer() {
+    log.Println("Starting Log HTTP Server")
+
+    db, err := NewRealDB(os.Getenv("DATABASE_URL"), dbPoolConfig())
+    if err != nil {
+        log.Fatalf("startHTTPServer: fatal error connecting to the database - %v", err)
+    }
+    defer db.Close()
+
+    appMetrics.StartLogging()
+    go reportDBPoolStats(db)
+
+    port := os.Getenv("PORT")
+    if port == "" {
+        port = "5000"
+    }
+
+    server := &http.Server{
+        Addr:    ":" + port,
+        Handler: NewLogServer(db, *httpRequestTimeout, nil).Handler(),
+    }
+
+    // ListenAndServe returns as soon as Shutdown starts, done is closed once
+    // the in-flight requests are finished with the database
+    done := make(chan struct{})
+
+    go func() {
+        defer close(done)
+
+        signals := make(chan os.Signal, 1)
+        signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+        sig := <-signals
+        log.Printf("Received %v, shutting down the HTTP server", sig)
+
+        ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+        defer cancel()
+
+        if err := server.Shutdown(ctx); err != nil {
+            log.Printf("startHTTPServer: error shutting down - %v", err)
+        }
+    }()
+
+    log.Printf("Listening on :%s", port)
+
+    if err = server.ListenAndServe(); err != http.ErrServerClosed {
+        log.Fatalf("startHTTPServer: error serving HTTP - %v", err)
+    }
+
+    <-done
+}
@@ -2,8 +2,13 @@ package main
 
 import (
     "log"
+    "net/http"
     "os"
+    "os/signal"
+    "strings"
     "sync"
+    "syscall"
+    "time"
 )
 
 func startLogPartsProcessing() {
@@ -11,54 +16,237 @@ func startLogPartsProcessing() {
 
     log.Println("Starting Log Stream Processing")
 
-    if err = testDatabaseConnection(); err != nil {
+    config, err := loadConsumerConfig()
+    if err != nil {
+        log.Fatalf("startLogPartsProcessing: invalid consumer configuration - %v", err)
+    }
+    log.Printf("Consumer configuration: %v", config)
+
+    log.Println("Connecting to the database")
+
+    db, err := NewRealDB(os.Getenv("DATABASE_URL"), dbPoolConfig())
+    if err != nil {
         log.Fatalf("startLogPartsProcessing: fatal error connection to the database - %v", err)
     }
 
-    if _, err = newPusherClient(); err != nil {
-        log.Fatalf("startLogPartsProcessing: error setting up Pusher - %v", err)
+    // Pusher comes first, only its errors fail streaming a log part
+    pushers := MultiPusher{}
+
+    var coalescer *CoalescingPusher
+
+    if *pusherEnabled {
+        pc, err := newPusherClient()
+        if err != nil {
+            log.Fatalf("startLogPartsProcessing: error setting up Pusher - %v", err)
+        }
+
+        if *pusherBreakerFailures > 0 {
+            pc.UseCircuitBreaker(NewCircuitBreaker(*pusherBreakerFailures, *pusherBreakerSuccesses, *pusherBreakerCooldown))
+        }
+
+        if *pusherOccupancyInterval > 0 {
+            pc.SkipVacantChannels(*pusherOccupancyInterval)
+        }
+
+        if *pusherCoalesceWindow > 0 {
+            coalescer = NewCoalescingPusher(pc, *pusherCoalesceWindow, *streamToPusherTimeout)
+            pushers = append(pushers, coalescer)
+        } else {
+            pushers = append(pushers, pc)
+        }
+    }
+
+    var webSocketServer *http.Server
+    if *webSocketPort != "" {
+        ws := NewWebSocketServer(os.Getenv("PUSHER_KEY"), splitOrigins(*webSocketOrigins))
+        pushers = append(pushers, ws)
+        webSocketServer = startWebSocketServer(*webSocketPort, ws)
+    }
+
+    var liveServer *http.Server
+    var hub *PostgresHub
+    if *ssePort != "" {
+        hub, err = NewPostgresHub(os.Getenv("DATABASE_URL"))
+        if err != nil {
+            log.Fatalf("startLogPartsProcessing: error listening for live log parts - %v", err)
+        }
+        pushers = append(pushers, hub)
+        liveServer = startLiveLogServer(*ssePort, db, hub.LocalHub)
+    }
+
+    var livePusher Pusher = pushers
+
+    if *reorderWindow > 0 {
+        livePusher = NewReorderingPusher(livePusher, *reorderWindow, *sequenceTTL, *streamToPusherTimeout)
+    }
+
+    var asyncPusher *AsyncPusher
+    if *pusherQueueSize > 0 {
+        asyncPusher = NewAsyncPusher(livePusher, *pusherQueueSize, *pusherQueueWorkers, pusherQueueOverflow, *streamToPusherTimeout, streamToPusherRetry)
+        livePusher = asyncPusher
     }
 
     appMetrics.StartLogging()
+    go reportDBPoolStats(db)
 
     log.Println("Connecting to AMQP")
 
-    amqp, err := NewMessageBroker(os.Getenv("RABBITMQ_URL"))
+    amqp, err := NewMessageBroker(os.Getenv("RABBITMQ_URL"), config.QueueName)
     if err != nil {
         log.Fatalf("startLogPartsProcessing: error connecting to Rabbit - %v", err)
     }
-    defer amqp.Close()
 
-    log.Printf("Subscribing to reporting.jobs.logs")
+    processorDB := db
+
+    if *logIdCacheSize > 0 {
+        cache := NewLogIdCache(*logIdCacheSize, *logIdCacheTTL, *logIdCacheNegativeTTL)
+        processorDB = NewCachingDB(processorDB, cache)
+    }
+
+    var batcher *LogPartBatcher
+    if *logPartBatchSize > 0 {
+        batcher = NewLogPartBatcher(db, *logPartBatchSize, *logPartBatchWait, *createLogPartTimeout)
+        processorDB = NewBatchingDB(processorDB, batcher)
+    }
+
+    var sequences *SequenceTracker
+    if *trackSequences {
+        sequences = NewSequenceTracker(*sequenceTTL)
+    }
+
+    log.Printf("Subscribing to %s", config.QueueName)
 
     var wg sync.WaitGroup
-    wg.Add(3)
-    for i := 0; i < 3; i++ {
+    wg.Add(config.Subscriptions)
+    for i := 0; i < config.Subscriptions; i++ {
         go func() {
             defer wg.Done()
 
-            err = amqp.Subscribe("reporting.jobs.logs", 10, createLogPartsProcessor)
+            err := amqp.Subscribe(config.QueueName, config.Consumers, config.Prefetch, logPartsProcessorFactory(processorDB, livePusher, sequences))
             if err != nil {
                 log.Fatalf("startLogPartsProcessing: error setting up subscriptions - %v", err)
             }
 
         }()
     }
-    wg.Wait()
+
+    done := make(chan struct{})
+    go func() {
+        wg.Wait()
+        close(done)
+    }()
+
+    signals := make(chan os.Signal, 1)
+    signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+    drained := true
+
+    select {
+    case <-done:
+    case sig := <-signals:
+        log.Printf("Received %v, draining in-flight log parts", sig)
+        amqp.Stop()
+
+        select {
+        case <-done:
+            log.Println("Drained in-flight log parts")
+        case <-time.After(*shutdownTimeout):
+            log.Printf("startLogPartsProcessing: gave up draining in-flight log parts after %v", *shutdownTimeout)
+            drained = false
+        }
+    }
+
+    if asyncPusher != nil {
+        asyncPusher.Close()
+    }
+
+    if coalescer != nil {
+        coalescer.Close()
+    }
+
+    if liveServer != nil {
+        liveServer.Close()
+        hub.Close()
+    }
+
+    if webSocketServer != nil {
+        webSocketServer.Close()
+    }
+
+    if batcher != nil {
+        batcher.Close()
+    }
+
+    // log parts still in flight keep using the database until the broker is
+    // closed, they are requeued unacked when the process exits
+    if drained {
+        db.Close()
+    } else {
+        log.Println("startLogPartsProcessing: leaving the database open for the log parts still in flight")
+    }
+
+    logMetrics(appMetrics)
+    amqp.Close()
 }
 
-func testDatabaseConnection() error {
-    log.Println("Checking the database connection details")
-    db, err := NewRealDB(os.Getenv("DATABASE_URL"))
-    if err != nil {
-        return err
+func reportDBPoolStats(db DB) {
+    for _ = range time.Tick(10 * time.Second) {
+        appMetrics.UpdateDBPoolStats(db.Stats())
     }
-    defer db.Close()
+}
+
+// startLiveLogServer serves the logs, including the SSE endpoint fed by hub,
+// from the streaming processes.
+func startLiveLogServer(port string, db DB, hub *LocalHub) *http.Server {
+    server := &http.Server{
+        Addr:    ":" + port,
+        Handler: NewLogServer(db, *httpRequestTimeout, hub).Handler(),
+    }
+
+    go func() {
+        log.Printf("Serving live logs on :%s", port)
 
-    return nil
+        if err := server.ListenAndServe(); err != http.ErrServerClosed {
+            log.Fatalf("startLiveLogServer: error serving HTTP - %v", err)
+        }
+    }()
+
+    return server
+}
+
+// startWebSocketServer serves the Pusher protocol endpoint of ws, for clients
+// which can't reach Pusher itself.
+func startWebSocketServer(port string, ws *WebSocketServer) *http.Server {
+    mux := http.NewServeMux()
+    mux.Handle("/app/", ws)
+
+    server := &http.Server{
+        Addr:    ":" + port,
+        Handler: mux,
+    }
+
+    go func() {
+        log.Printf("Serving the Pusher protocol over WebSockets on :%s", port)
+
+        if err := server.ListenAndServe(); err != http.ErrServerClosed {
+            log.Fatalf("startWebSocketServer: error serving HTTP - %v", err)
+        }
+    }()
+
+    return server
 }
 
-func newPusherClient() (Pusher, error) {
+func splitOrigins(value string) []string {
+    origins := []string{}
+    for _, origin := range strings.Split(value, ",") {
+        if origin = strings.TrimSpace(origin); origin != "" {
+            origins = append(origins, origin)
+        }
+    }
+    return origins
+}
+
+func newPusherClient() (*LivePusher, error) {
     p, err := NewPusher(os.Getenv("PUSHER_KEY"), os.Getenv("PUSHER_SECRET"), os.Getenv("PUSHER_APP_ID"))
     if err != nil {
         return nil, err
@@ -66,20 +254,28 @@ func newPusherClient() (Pusher, error) {
     return p, nil
 }
 
-func createLogPartsProcessor(logProcessorNum int) MessageProcessor {
+// logPartsProcessorFactory returns the function creating the processors of a
+// subscription, db, pc and sequences are shared by all processors.
+func logPartsProcessorFactory(db DB, pc Pusher, sequences *SequenceTracker) func(int) MessageProcessor {
+    return func(logProcessorNum int) MessageProcessor {
+        return createLogPartsProcessor(logProcessorNum, db, pc, sequences)
+    }
+}
+
+func createLogPartsProcessor(logProcessorNum int, db DB, pc Pusher, sequences *SequenceTracker) MessageProcessor {
     log.Printf("Starting Log Processor %d", logProcessorNum+1)
 
-    db, err := NewRealDB(os.Getenv("DATABASE_URL"))
-    if err != nil {
-        log.Printf("createLogPartsProcessor: [%d] fatal error connecting to the database - %v", logProcessorNum+1, err)
-        return nil
+    timeouts := StageTimeouts{
+        FindLogId:      *findLogIdTimeout,
+        CreateLogPart:  *createLogPartTimeout,
+        StreamToPusher: *streamToPusherTimeout,
     }
 
-    pc, err := newPusherClient()
-    if err != nil {
-        log.Printf("createLogPartsProcessor: [%d] fatal error setting up pusher - %v", logProcessorNum+1, err)
-        return nil
+    retries := StageRetries{
+        FindLogId:      findLogIdRetry,
+        CreateLogPart:  createLogPartRetry,
+        StreamToPusher: streamToPusherRetry,
     }
 
-    return &LogPartsProcessor{db, pc}
+    return &LogPartsProcessor{db, pc, timeouts, retries, *createMissingLogs, sequences}
 }
@@ -0,0 +1,60 @@
+package main
+
+import (
+    "context"
+    "log"
+    "os"
+)
+
+func startMigration(command string) {
+    db, err := openDatabase(os.Getenv("DATABASE_URL"), dbPoolConfig())
+    if err != nil {
+        log.Fatalf("startMigration: fatal error connecting to the database - %v", err)
+    }
+    defer db.Close()
+
+    ctx := context.Background()
+
+    switch command {
+    case "up":
+        applied, err := migrateUp(ctx, db)
+        for _, migration := range applied {
+            log.Printf("Applied migration %d_%s", migration.Version, migration.Name)
+        }
+        if err != nil {
+            log.Fatalf("startMigration: %v", err)
+        }
+        if len(applied) == 0 {
+            log.Println("No pending migrations")
+        }
+    case "down":
+        reverted, err := migrateDown(ctx, db)
+        if err != nil {
+            log.Fatalf("startMigration: %v", err)
+        }
+        if reverted == nil {
+            log.Println("No applied migrations")
+            return
+        }
+        log.Printf("Reverted migration %d_%s", reverted.Version, reverted.Name)
+    case "baseline":
+        if err := migrateBaseline(ctx, db); err != nil {
+            log.Fatalf("startMigration: %v", err)
+        }
+        log.Printf("Marked the existing schema as migration %d_baseline", baselineVersion)
+    case "status":
+        statuses, err := migrationStatuses(ctx, db)
+        if err != nil {
+            log.Fatalf("startMigration: %v", err)
+        }
+        for _, status := range statuses {
+            if status.AppliedAt == nil {
+                log.Printf("pending  %d_%s", status.Version, status.Name)
+            } else {
+                log.Printf("applied  %d_%s (%s)", status.Version, status.Name, status.AppliedAt.Format("2006-01-02 15:04:05"))
+            }
+        }
+    default:
+        log.Fatalf("startMigration: unknown migrate command %q, use up, down, baseline or status", command)
+    }
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+    "log"
+    "os"
+)
+
+func startDeadLetterReplay() {
+    config, err := loadConsumerConfig()
+    if err != nil {
+        log.Fatalf("startDeadLetterReplay: invalid consumer configuration - %v", err)
+    }
+
+    log.Println("Connecting to AMQP")
+
+    amqp, err := NewMessageBroker(os.Getenv("RABBITMQ_URL"), config.QueueName)
+    if err != nil {
+        log.Fatalf("startDeadLetterReplay: error connecting to Rabbit - %v", err)
+    }
+    defer amqp.Close()
+
+    log.Printf("Replaying dead lettered messages for %s", config.QueueName)
+
+    count, err := amqp.ReplayDeadLetters(config.QueueName)
+    if err != nil {
+        log.Fatalf("startDeadLetterReplay: error replaying dead lettered messages after %d message(s) - %v", count, err)
+    }
+
+    log.Printf("Replayed %d dead lettered message(s)", count)
+}
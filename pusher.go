@@ -1,27 +1,61 @@
 package main
 
 import (
+    "context"
     "encoding/json"
     "fmt"
     "github.com/timonv/pusher"
+    "log"
+    "net/http"
+    "strings"
+    "time"
+    "unicode/utf8"
 )
 
+func init() {
+    pusher.HttpClient.Transport = &serverErrorTransport{http.DefaultTransport}
+
+    // Publish stops waiting once its context is done, this bounds the
+    // requests left running in the background when that happens.
+    pusher.HttpClient.Timeout = 30 * time.Second
+}
+
 type Pusher interface {
-    Publish(int, int, string, bool) error
+    Publish(context.Context, int, int, string, bool) error
+}
+
+// QueueingPusher is implemented by Pushers which may only queue log parts
+// when publishing, and time and retry the actual publish themselves.
+type QueueingPusher interface {
+    Queued() bool
 }
 
 type LivePusher struct {
-    client *pusher.Client
+    client   *pusher.Client
+    occupied *OccupiedChannels
+    breaker  *CircuitBreaker
 }
 
+// pusherMaxEventSize is the largest event data Pusher accepts, larger
+// events are rejected.
+const pusherMaxEventSize = 10 * 1024
+
+// PusherPayload is the data of a job:log event. Log parts too large for a
+// single event are split into several, numbered from 1 by Chunk out of
+// Chunks, which clients concatenate in order. Only the last chunk of a final
+// part is marked final. Events merging several log parts list them in
+// Numbers, Number being the first one.
 type PusherPayload struct {
     JobId   int    `json:"id"`
     Number  int    `json:"number"`
+    Numbers []int  `json:"numbers,omitempty"`
     Content string `json:"_log"`
     Final   bool   `json:"final"`
+    Chunk   int    `json:"chunk,omitempty"`
+    Chunks  int    `json:"chunks,omitempty"`
 }
 
-func (p *LivePusher) Publish(jobId int, number int, content string, final bool) error {
+func (p *LivePusher) Publish(ctx context.Context, jobId int, number int, content string, final bool) error {
     payload := PusherPayload{
         JobId:   jobId,
         Number:  number,
@@ -29,21 +63,201 @@ func (p *LivePusher) Publish(jobId int, number int, content string, final bool)
         Final:   final,
     }
 
+    return p.PublishPayload(ctx, payload)
+}
+
+// PublishPayload publishes payload as one or more job:log events.
+func (p *LivePusher) PublishPayload(ctx context.Context, payload PusherPayload) error {
+    channel := fmt.Sprintf("job-%d", payload.JobId)
+
+    if p.occupied != nil && !p.occupied.Occupied(channel) {
+        appMetrics.MarkVacantPusherChannelCount()
+        return nil
+    }
+
+    payloads, err := splitPusherPayload(payload, pusherMaxEventSize)
+    if err != nil {
+        return err
+    }
+
+    if len(payloads) > 1 {
+        appMetrics.MarkOversizePusherEventCount()
+    }
+
+    for i, payload := range payloads {
+        if err = p.publish(ctx, channel, payload); err != nil {
+            // publishing the part again would resend the chunks which went
+            // out, clients see the missing ones from the chunk numbers
+            if e, ok := err.(*PusherPublishError); ok && i > 0 {
+                e.Transient = false
+            }
+            return err
+        }
+    }
+
+    return nil
+}
+
+func (p *LivePusher) publish(ctx context.Context, channel string, payload PusherPayload) error {
     jsonPayload, err := json.Marshal(&payload)
     if err != nil {
         return fmt.Errorf("Publish: error during json.marshal: %v", err)
     }
 
-    channel := fmt.Sprintf("job-%d", payload.JobId)
+    if p.breaker != nil {
+        if err = p.breaker.Allow(); err != nil {
+            return &PusherPublishError{err, false}
+        }
+    }
 
-    if err = p.client.Publish(string(jsonPayload), "job:log", channel); err != nil {
-        return fmt.Errorf("Publish: error publishing to pusher: %v", err)
+    // the vendored client can't be cancelled, so the request is left to
+    // finish in the background when ctx is done first
+    published := make(chan error, 1)
+    go func() {
+        published <- p.client.Publish(string(jsonPayload), "job:log", channel)
+    }()
+
+    unreachable := false
+    select {
+    case err = <-published:
+        if err != nil {
+            unreachable = isPusherTransportError(err)
+            err = &PusherPublishError{err, unreachable}
+        }
+    case <-ctx.Done():
+        // the abandoned request may still be accepted, so publishing the
+        // event again could send it twice
+        unreachable = true
+        err = &PusherPublishError{ctx.Err(), false}
     }
 
-    return nil
+    // only Pusher being unreachable or slow trips the breaker, it is up when
+    // it rejects a request
+    if p.breaker != nil {
+        p.breaker.Record(unreachable)
+    }
+
+    return err
+}
+
+// splitPusherPayload splits payload into chunks whose JSON encoding fits in
+// maxSize bytes. Content is only split between UTF-8 characters and ANSI
+// escape sequences, so each chunk renders on its own.
+func splitPusherPayload(payload PusherPayload, maxSize int) ([]PusherPayload, error) {
+    jsonPayload, err := json.Marshal(&payload)
+    if err != nil {
+        return nil, fmt.Errorf("Publish: error during json.marshal: %v", err)
+    }
+
+    if len(jsonPayload) <= maxSize {
+        return []PusherPayload{payload}, nil
+    }
+
+    // the room left for content next to the largest chunk numbers
+    empty := payload
+    empty.Content = ""
+    empty.Chunk = len(payload.Content)
+    empty.Chunks = len(payload.Content)
+    jsonEmpty, err := json.Marshal(&empty)
+    if err != nil {
+        return nil, fmt.Errorf("Publish: error during json.marshal: %v", err)
+    }
+
+    budget := maxSize - len(jsonEmpty)
+    if budget < maxANSIEscapeLength*len(`\u001b`) {
+        return nil, fmt.Errorf("Publish: event size limit of %d bytes is too small", maxSize)
+    }
+
+    var contents []string
+    start, size := 0, 0
+    for i := 0; i < len(payload.Content); {
+        n := logTokenLength(payload.Content[i:])
+        encoded := jsonEncodedLength(payload.Content[i : i+n])
+
+        if size > 0 && size+encoded > budget {
+            contents = append(contents, payload.Content[start:i])
+            start, size = i, 0
+        }
+
+        size += encoded
+        i += n
+    }
+    contents = append(contents, payload.Content[start:])
+
+    payloads := make([]PusherPayload, len(contents))
+    for i, content := range contents {
+        payloads[i] = PusherPayload{
+            JobId:   payload.JobId,
+            Number:  payload.Number,
+            Numbers: payload.Numbers,
+            Content: content,
+            Final:   payload.Final && i == len(contents)-1,
+            Chunk:   i + 1,
+            Chunks:  len(contents),
+        }
+    }
+
+    return payloads, nil
+}
+
+// maxANSIEscapeLength bounds how much of a malformed escape sequence is kept
+// together.
+const maxANSIEscapeLength = 32
+
+// logTokenLength returns the length of the UTF-8 character or ANSI escape
+// sequence at the start of s.
+func logTokenLength(s string) int {
+    if s[0] == '\x1b' && len(s) > 1 {
+        if s[1] != '[' {
+            _, size := utf8.DecodeRuneInString(s[1:])
+            return 1 + size
+        }
+
+        // CSI sequences end with a byte in the range 0x40-0x7e
+        for i := 2; i < len(s) && i < maxANSIEscapeLength; i++ {
+            if s[i] >= 0x40 && s[i] <= 0x7e {
+                return i + 1
+            }
+        }
+        return 2
+    }
+
+    _, size := utf8.DecodeRuneInString(s)
+    return size
 }
 
-func NewPusher(key string, secret string, appId string) (Pusher, error) {
+// jsonEncodedLength returns the length of s once encoded as part of a JSON
+// string.
+func jsonEncodedLength(s string) int {
+    encoded, _ := json.Marshal(s)
+    return len(encoded) - 2
+}
+
+// MultiPusher publishes to several Pushers side by side, such as Pusher
+// itself and the PostgresHub feeding the SSE endpoints. Only an error of the
+// first Pusher fails the publish, the others are best effort and their errors
+// are only logged: failing the publish would retry it, sending the part again
+// to the clients of all Pushers.
+type MultiPusher []Pusher
+
+func (mp MultiPusher) Publish(ctx context.Context, jobId int, number int, content string, final bool) error {
+    var primaryErr error
+
+    for i, p := range mp {
+        err := p.Publish(ctx, jobId, number, content, final)
+        switch {
+        case err == nil:
+        case i == 0:
+            primaryErr = err
+        default:
+            log.Printf("Publish: error publishing log part %d of job %d to %T - %v", number, jobId, p, err)
+        }
+    }
+
+    return primaryErr
+}
+
+func NewPusher(key string, secret string, appId string) (*LivePusher, error) {
     if key == "" {
         return nil, fmt.Errorf("pusher key was empty")
     }
@@ -58,5 +272,73 @@ func NewPusher(key string, secret string, appId string) (Pusher, error) {
 
     client := pusher.NewClient(appId, key, secret)
 
-    return &LivePusher{client}, nil
+    return &LivePusher{client, nil, nil}, nil
+}
+
+// SkipVacantChannels stops publishing to job channels without subscribers,
+// the occupied channels are fetched from Pusher every interval. It has to be
+// called before publishing.
+func (p *LivePusher) SkipVacantChannels(interval time.Duration) {
+    p.occupied = NewOccupiedChannels(interval)
+    go p.occupied.Track(p.client)
+}
+
+// UseCircuitBreaker short-circuits publishes while breaker is open. It has to
+// be called before publishing.
+func (p *LivePusher) UseCircuitBreaker(breaker *CircuitBreaker) {
+    p.breaker = breaker
+}
+
+// isPusherTimeoutError reports whether a Publish stopped waiting for Pusher
+// before it answered. The event may or may not have been published.
+func isPusherTimeoutError(err error) bool {
+    switch e := err.(type) {
+    case *StreamToPusherError:
+        return isPusherTimeoutError(e.Err)
+    case *PusherPublishError:
+        return e.Err == context.DeadlineExceeded || e.Err == context.Canceled
+    }
+
+    return false
+}
+
+// isCircuitOpenError reports whether a Publish was short-circuited by an
+// open CircuitBreaker.
+func isCircuitOpenError(err error) bool {
+    switch e := err.(type) {
+    case *StreamToPusherError:
+        return isCircuitOpenError(e.Err)
+    case *PusherPublishError:
+        return e.Err == errCircuitOpen
+    }
+
+    return false
+}
+
+// serverErrorTransport turns Pusher 5xx responses into transport errors, the
+// vendored client otherwise reports them the same way as rejected requests.
+type serverErrorTransport struct {
+    transport http.RoundTripper
+}
+
+func (t *serverErrorTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+    resp, err := t.transport.RoundTrip(req)
+    if err != nil {
+        return nil, err
+    }
+
+    if resp.StatusCode >= 500 {
+        resp.Body.Close()
+        return nil, fmt.Errorf("pusher server error: %s", resp.Status)
+    }
+
+    return resp, nil
+}
+
+// isPusherTransportError reports whether a Publish error came from the HTTP
+// round trip (connection errors, timeouts and 5xx responses) rather than from
+// Pusher rejecting the request. The vendored client only returns strings, in
+// the form "pusher: POST failed: Post <url>: <cause>" for the former.
+func isPusherTransportError(err error) bool {
+    return strings.HasPrefix(err.Error(), "pusher: POST failed: Post ")
 }
@@ -0,0 +1,176 @@
+package main
+
+import (
+    "encoding/json"
+    "strings"
+    "testing"
+    "unicode/utf8"
+)
+
+func TestSplitPusherPayload(t *testing.T) {
+    tests := []struct {
+        name    string
+        content string
+        final   bool
+        maxSize int
+        chunks  int
+        // check is called with every chunk's content
+        check func(string) bool
+    }{
+        {
+            name:    "fits in one event",
+            content: "hello world",
+            final:   true,
+            maxSize: 300,
+            chunks:  1,
+        },
+        {
+            name:    "ascii",
+            content: strings.Repeat("abcdefghij", 100),
+            final:   true,
+            maxSize: 300,
+        },
+        {
+            name:    "multibyte characters",
+            content: strings.Repeat("é✓😀", 200),
+            final:   true,
+            maxSize: 300,
+            check:   utf8.ValidString,
+        },
+        {
+            name:    "ansi escape sequences",
+            content: strings.Repeat("\x1b[31m", 200),
+            maxSize: 300,
+            check: func(chunk string) bool {
+                return len(chunk)%len("\x1b[31m") == 0 && strings.HasPrefix(chunk, "\x1b[31m")
+            },
+        },
+        {
+            name:    "ansi escape sequences between text",
+            content: strings.Repeat("\x1b[0;32mok\x1b[0m ", 100),
+            final:   true,
+            maxSize: 300,
+            check: func(chunk string) bool {
+                for _, escape := range []string{"\x1b[0;32m", "\x1b[0m"} {
+                    for i := 1; i < len(escape); i++ {
+                        if strings.HasSuffix(chunk, escape[:i]) {
+                            return false
+                        }
+                    }
+                }
+                return true
+            },
+        },
+        {
+            name:    "characters growing when json escaped",
+            content: strings.Repeat("<\"\\\n\x01&>", 100),
+            maxSize: 300,
+        },
+    }
+
+    for _, test := range tests {
+        payload := PusherPayload{JobId: 12345, Number: 7, Content: test.content, Final: test.final}
+
+        chunks, err := splitPusherPayload(payload, test.maxSize)
+        if err != nil {
+            t.Errorf("%s: %v", test.name, err)
+            continue
+        }
+
+        if test.chunks > 0 && len(chunks) != test.chunks {
+            t.Errorf("%s: expected %d chunks, got %d", test.name, test.chunks, len(chunks))
+        }
+        if test.chunks == 0 && len(chunks) < 2 {
+            t.Errorf("%s: expected the content to be split, got %d chunk", test.name, len(chunks))
+        }
+
+        var content strings.Builder
+        for i, chunk := range chunks {
+            content.WriteString(chunk.Content)
+
+            data, err := json.Marshal(&chunk)
+            if err != nil {
+                t.Fatal(err)
+            }
+            if len(data) > test.maxSize {
+                t.Errorf("%s: chunk %d is %d bytes, more than %d", test.name, i+1, len(data), test.maxSize)
+            }
+
+            if chunk.JobId != payload.JobId || chunk.Number != payload.Number {
+                t.Errorf("%s: chunk %d is for job %d part %d", test.name, i+1, chunk.JobId, chunk.Number)
+            }
+
+            if len(chunks) > 1 && (chunk.Chunk != i+1 || chunk.Chunks != len(chunks)) {
+                t.Errorf("%s: chunk %d is numbered %d of %d", test.name, i+1, chunk.Chunk, chunk.Chunks)
+            }
+
+            if last := i == len(chunks)-1; chunk.Final != (test.final && last) {
+                t.Errorf("%s: chunk %d of %d has final %v", test.name, i+1, len(chunks), chunk.Final)
+            }
+
+            if test.check != nil && !test.check(chunk.Content) {
+                t.Errorf("%s: chunk %d was split inside a character or escape sequence: %q", test.name, i+1, chunk.Content)
+            }
+        }
+
+        if content.String() != test.content {
+            t.Errorf("%s: the chunks don't add up to the content", test.name)
+        }
+    }
+}
+
+func TestSplitPusherPayloadExactFit(t *testing.T) {
+    payload := PusherPayload{JobId: 1, Number: 2, Content: strings.Repeat("x", 400), Final: true}
+
+    data, err := json.Marshal(&payload)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    chunks, err := splitPusherPayload(payload, len(data))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(chunks) != 1 || chunks[0].Chunk != 0 || chunks[0].Content != payload.Content {
+        t.Errorf("expected a payload of exactly the maximum size to be sent as is, got %d chunks", len(chunks))
+    }
+
+    chunks, err = splitPusherPayload(payload, len(data)-1)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(chunks) < 2 {
+        t.Errorf("expected a payload one byte over the maximum size to be split")
+    }
+}
+
+func TestSplitPusherPayloadLimitTooSmall(t *testing.T) {
+    payload := PusherPayload{JobId: 1, Number: 2, Content: strings.Repeat("x", 200)}
+
+    if _, err := splitPusherPayload(payload, 100); err == nil {
+        t.Error("expected an error for a limit leaving no room for content")
+    }
+}
+
+func TestLogTokenLength(t *testing.T) {
+    tests := []struct {
+        s      string
+        length int
+    }{
+        {"a", 1},
+        {"é", 2},
+        {"😀x", 4},
+        {"\x1b[31mx", 5},
+        {"\x1b[0;32;1mx", 9},
+        {"\x1b(B", 2},
+        {"\x1b[", 2},
+        {"\x1b[" + strings.Repeat("1", 40) + "m", 2},
+        {"\xff", 1},
+    }
+
+    for _, test := range tests {
+        if length := logTokenLength(test.s); length != test.length {
+            t.Errorf("logTokenLength(%q) = %d, expected %d", test.s, length, test.length)
+        }
+    }
+}
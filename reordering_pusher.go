@@ -0,0 +1,182 @@
+package main
+
+import (
+    "context"
+    "log"
+    "sort"
+    "sync"
+    "time"
+)
+
+// ReorderingPusher holds the log parts of a job arriving ahead of a missing
+// part for up to window, and publishes them in order once the missing part
+// arrives. When it doesn't arrive in time the held parts are published
+// anyway. Parts arriving late are published right away. Jobs are expected
+// to start at firstLogPartNumber, and the position of a job without a final
+// part is kept for idleTTL after its last log part.
+//
+// Publish only returns the error of the log part it was given. Held parts
+// are published later, their failures are logged and counted.
+type ReorderingPusher struct {
+    pusher    Pusher
+    window    time.Duration
+    idleTTL   time.Duration
+    timeout   time.Duration
+    mu        sync.Mutex
+    jobs      map[int]*reorderBuffer
+    lastSweep time.Time
+}
+
+type reorderBuffer struct {
+    next      int
+    held      map[int]PusherPayload
+    timer     *time.Timer
+    updatedAt time.Time
+}
+
+// NewReorderingPusher returns a ReorderingPusher publishing to pusher,
+// timeout bounds the publishes made once a window is over.
+func NewReorderingPusher(pusher Pusher, window time.Duration, idleTTL time.Duration, timeout time.Duration) *ReorderingPusher {
+    return &ReorderingPusher{
+        pusher:    pusher,
+        window:    window,
+        idleTTL:   idleTTL,
+        timeout:   timeout,
+        jobs:      map[int]*reorderBuffer{},
+        lastSweep: time.Now(),
+    }
+}
+
+func (rp *ReorderingPusher) Publish(ctx context.Context, jobId int, number int, content string, final bool) error {
+    payload := PusherPayload{
+        JobId:   jobId,
+        Number:  number,
+        Content: content,
+        Final:   final,
+    }
+
+    rp.mu.Lock()
+
+    now := time.Now()
+    if now.Sub(rp.lastSweep) > rp.idleTTL {
+        rp.sweep(now)
+    }
+
+    buffer := rp.jobs[jobId]
+    if buffer == nil {
+        buffer = &reorderBuffer{next: firstLogPartNumber, held: map[int]PusherPayload{}}
+        rp.jobs[jobId] = buffer
+    }
+    buffer.updatedAt = now
+
+    if number > buffer.next {
+        buffer.held[number] = payload
+        appMetrics.MarkHeldReorderCount()
+
+        if buffer.timer == nil {
+            buffer.timer = time.AfterFunc(rp.window, func() {
+                rp.expire(jobId, buffer)
+            })
+        }
+
+        rp.mu.Unlock()
+        return nil
+    }
+
+    var released []PusherPayload
+    if number == buffer.next {
+        released = rp.release(jobId, buffer, false)
+    }
+    rp.forgetFinished(jobId, buffer, append([]PusherPayload{payload}, released...))
+
+    rp.mu.Unlock()
+
+    err := rp.pusher.Publish(ctx, jobId, number, content, final)
+    rp.publishHeld(ctx, released)
+
+    return err
+}
+
+// release takes the held parts following buffer.next, or all of them when
+// expired, out of buffer.
+func (rp *ReorderingPusher) release(jobId int, buffer *reorderBuffer, expired bool) []PusherPayload {
+    var ready []PusherPayload
+
+    if expired {
+        for _, payload := range buffer.held {
+            ready = append(ready, payload)
+        }
+        sort.Slice(ready, func(i, j int) bool { return ready[i].Number < ready[j].Number })
+
+        if len(ready) > 0 {
+            buffer.next = ready[len(ready)-1].Number + 1
+        }
+        buffer.held = map[int]PusherPayload{}
+    } else {
+        buffer.next++
+        for {
+            payload, ok := buffer.held[buffer.next]
+            if !ok {
+                break
+            }
+            ready = append(ready, payload)
+            delete(buffer.held, buffer.next)
+            buffer.next++
+        }
+    }
+
+    if len(buffer.held) == 0 && buffer.timer != nil {
+        buffer.timer.Stop()
+        buffer.timer = nil
+    }
+
+    return ready
+}
+
+// forgetFinished forgets a job once its final part is published, nothing
+// follows it.
+func (rp *ReorderingPusher) forgetFinished(jobId int, buffer *reorderBuffer, ready []PusherPayload) {
+    if len(ready) > 0 && ready[len(ready)-1].Final && len(buffer.held) == 0 {
+        delete(rp.jobs, jobId)
+    }
+}
+
+// sweep forgets the jobs without held parts which had no log parts for
+// idleTTL.
+func (rp *ReorderingPusher) sweep(now time.Time) {
+    for jobId, buffer := range rp.jobs {
+        if len(buffer.held) == 0 && now.Sub(buffer.updatedAt) > rp.idleTTL {
+            delete(rp.jobs, jobId)
+        }
+    }
+
+    rp.lastSweep = now
+}
+
+func (rp *ReorderingPusher) expire(jobId int, buffer *reorderBuffer) {
+    rp.mu.Lock()
+    if rp.jobs[jobId] != buffer || buffer.timer == nil {
+        rp.mu.Unlock()
+        return
+    }
+    buffer.timer = nil
+    appMetrics.MarkExpiredReorderCount()
+    ready := rp.release(jobId, buffer, true)
+    rp.forgetFinished(jobId, buffer, ready)
+    rp.mu.Unlock()
+
+    ctx, cancel := context.WithTimeout(context.Background(), rp.timeout)
+    defer cancel()
+
+    rp.publishHeld(ctx, ready)
+}
+
+// publishHeld publishes the released log parts in order. Publish already
+// accepted them, so their failures are only logged and counted.
+func (rp *ReorderingPusher) publishHeld(ctx context.Context, payloads []PusherPayload) {
+    for _, payload := range payloads {
+        if err := rp.pusher.Publish(ctx, payload.JobId, payload.Number, payload.Content, payload.Final); countPusherError(err) {
+            log.Printf("publishHeld: error publishing held log part %d of job %d - %v", payload.Number, payload.JobId, err)
+        }
+    }
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "reflect"
+    "sync"
+    "testing"
+    "time"
+)
+
+// recordingPusher records the numbers published, failing those in fail.
+type recordingPusher struct {
+    mu        sync.Mutex
+    published []int
+    fail      map[int]error
+}
+
+func (p *recordingPusher) Publish(ctx context.Context, jobId int, number int, content string, final bool) error {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+
+    p.published = append(p.published, number)
+    return p.fail[number]
+}
+
+func (p *recordingPusher) numbers() []int {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+
+    return append([]int{}, p.published...)
+}
+
+func TestReorderingPusherOrder(t *testing.T) {
+    tests := []struct {
+        name      string
+        numbers   []int
+        published []int
+    }{
+        {"in order", []int{0, 1, 2}, []int{0, 1, 2}},
+        {"held until the missing part arrives", []int{2, 1, 0, 3}, []int{0, 1, 2, 3}},
+        {"held behind the first part number", []int{1}, []int{}},
+        {"late parts right away", []int{0, 1, 1, 0}, []int{0, 1, 1, 0}},
+    }
+
+    for _, test := range tests {
+        pusher := &recordingPusher{}
+        rp := NewReorderingPusher(pusher, time.Hour, time.Hour, time.Second)
+
+        for _, number := range test.numbers {
+            if err := rp.Publish(context.Background(), 1, number, "", false); err != nil {
+                t.Errorf("%s: publishing %d failed: %v", test.name, number, err)
+            }
+        }
+
+        if published := pusher.numbers(); !reflect.DeepEqual(published, test.published) {
+            t.Errorf("%s: expected %v to be published, got %v", test.name, test.published, published)
+        }
+    }
+}
+
+func TestReorderingPusherErrorAttribution(t *testing.T) {
+    errPart := errors.New("part failed")
+
+    tests := []struct {
+        name    string
+        fail    int
+        numbers []int
+        // errs is the error expected from publishing each of numbers
+        errs []error
+    }{
+        {"the failing part itself", 1, []int{0, 1}, []error{nil, errPart}},
+        {"a held part failing", 1, []int{1, 0}, []error{nil, nil}},
+        {"the part releasing held ones failing", 0, []int{1, 2, 0}, []error{nil, nil, errPart}},
+    }
+
+    for _, test := range tests {
+        pusher := &recordingPusher{fail: map[int]error{test.fail: errPart}}
+        rp := NewReorderingPusher(pusher, time.Hour, time.Hour, time.Second)
+
+        for i, number := range test.numbers {
+            if err := rp.Publish(context.Background(), 1, number, "", false); err != test.errs[i] {
+                t.Errorf("%s: publishing %d returned %v, expected %v", test.name, number, err, test.errs[i])
+            }
+        }
+
+        if published := pusher.numbers(); len(published) != len(test.numbers) {
+            t.Errorf("%s: expected all parts to be published, got %v", test.name, published)
+        }
+    }
+}
+
+func TestReorderingPusherWindowExpiry(t *testing.T) {
+    pusher := &recordingPusher{}
+    rp := NewReorderingPusher(pusher, 10*time.Millisecond, time.Hour, time.Second)
+
+    rp.Publish(context.Background(), 1, 3, "", false)
+    rp.Publish(context.Background(), 1, 2, "", false)
+
+    deadline := time.Now().Add(5 * time.Second)
+    for len(pusher.numbers()) < 2 && time.Now().Before(deadline) {
+        time.Sleep(5 * time.Millisecond)
+    }
+
+    // the missing parts are late now and published right away
+    rp.Publish(context.Background(), 1, 0, "", false)
+    rp.Publish(context.Background(), 1, 4, "", false)
+
+    if published := pusher.numbers(); !reflect.DeepEqual(published, []int{2, 3, 0, 4}) {
+        t.Errorf("expected the held parts to be published in order once the window is over, got %v", published)
+    }
+}
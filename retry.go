@@ -0,0 +1,103 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "math/rand"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// RetryPolicy describes how often and how quickly a failing stage is tried
+// again. Only transient errors are retried, see isTransientError.
+//
+// As a flag it is written as "attempts=3,base=50ms,max=1s,jitter=0.2", any of
+// the keys may be left out to keep their current value.
+type RetryPolicy struct {
+    MaxAttempts int
+    BaseDelay   time.Duration
+    MaxDelay    time.Duration
+    // Jitter is the fraction of each delay which is randomized, from 0 (none)
+    // to 1 (anything between no delay and the full delay).
+    Jitter float64
+}
+
+// Do calls f until it succeeds, fails with a permanent error, runs out of
+// attempts or ctx is done, and returns the last error. Every attempt is
+// recorded against the stage in the metrics.
+func (p RetryPolicy) Do(ctx context.Context, stage string, f func() error) error {
+    for attempt := 1; ; attempt++ {
+        appMetrics.MarkStageAttempt(stage, attempt)
+
+        err := f()
+        if err == nil || !isTransientError(err) || attempt >= p.MaxAttempts {
+            return err
+        }
+
+        select {
+        case <-time.After(backoffDelay(attempt, p.BaseDelay, p.MaxDelay, p.Jitter)):
+        case <-ctx.Done():
+            return err
+        }
+    }
+}
+
+func (p *RetryPolicy) String() string {
+    return fmt.Sprintf("attempts=%d,base=%v,max=%v,jitter=%v", p.MaxAttempts, p.BaseDelay, p.MaxDelay, p.Jitter)
+}
+
+func (p *RetryPolicy) Set(value string) error {
+    for _, setting := range strings.Split(value, ",") {
+        kv := strings.SplitN(setting, "=", 2)
+        if len(kv) != 2 {
+            return fmt.Errorf("invalid retry setting %q, expected key=value", setting)
+        }
+
+        var err error
+        switch kv[0] {
+        case "attempts":
+            p.MaxAttempts, err = strconv.Atoi(kv[1])
+        case "base":
+            p.BaseDelay, err = time.ParseDuration(kv[1])
+        case "max":
+            p.MaxDelay, err = time.ParseDuration(kv[1])
+        case "jitter":
+            p.Jitter, err = strconv.ParseFloat(kv[1], 64)
+            if err == nil && (p.Jitter < 0 || p.Jitter > 1) {
+                err = fmt.Errorf("jitter must be between 0 and 1")
+            }
+        default:
+            return fmt.Errorf("unknown retry setting %q", kv[0])
+        }
+
+        if err != nil {
+            return fmt.Errorf("invalid retry setting %q: %v", setting, err)
+        }
+    }
+
+    return nil
+}
+
+// backoffDelay doubles base for every attempt up to max, and randomizes the
+// given fraction of it so that clients don't retry in lock step.
+func backoffDelay(attempt int, base time.Duration, max time.Duration, jitter float64) time.Duration {
+    delay := base
+    for i := 1; i < attempt && delay < max; i++ {
+        delay *= 2
+    }
+    if delay > max {
+        delay = max
+    }
+
+    if jitter > 1 {
+        jitter = 1
+    }
+
+    random := time.Duration(float64(delay) * jitter)
+    if random <= 0 {
+        return delay
+    }
+
+    return delay - random + time.Duration(rand.Int63n(int64(random)+1))
+}
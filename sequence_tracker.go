@@ -0,0 +1,141 @@
+package main
+
+import (
+    "log"
+    "sync"
+    "time"
+)
+
+// SequenceTracker follows the numbers of the log parts of every job, and
+// warns about gaps, duplicates and parts arriving after the final one. It
+// only sees the log parts consumed by its own process, so it is only useful
+// when a job's parts all go to the same process.
+//
+// Jobs without new parts for ttl are forgotten, reporting the gaps they
+// still have. Jobs are expected to start at firstLogPartNumber, so parts of
+// jobs which were already running when the process started are reported as
+// a gap at first.
+type SequenceTracker struct {
+    ttl       time.Duration
+    mu        sync.Mutex
+    jobs      map[int]*jobSequence
+    lastSweep time.Time
+}
+
+type jobSequence struct {
+    next      int
+    missing   []numberRange
+    final     int
+    hasFinal  bool
+    updatedAt time.Time
+}
+
+// numberRange is a range of log part numbers, including From and To.
+type numberRange struct {
+    From int
+    To   int
+}
+
+// firstLogPartNumber is the number of the first log part of every job.
+const firstLogPartNumber = 0
+
+func NewSequenceTracker(ttl time.Duration) *SequenceTracker {
+    return &SequenceTracker{ttl: ttl, jobs: map[int]*jobSequence{}, lastSweep: time.Now()}
+}
+
+func (st *SequenceTracker) Track(jobId int, number int, final bool) {
+    st.mu.Lock()
+    defer st.mu.Unlock()
+
+    now := time.Now()
+    if now.Sub(st.lastSweep) > st.ttl {
+        st.sweep(now)
+    }
+
+    seq := st.jobs[jobId]
+    if seq == nil {
+        seq = &jobSequence{next: firstLogPartNumber}
+        st.jobs[jobId] = seq
+    }
+    seq.updatedAt = now
+
+    if seq.hasFinal && number > seq.final {
+        warnSequence("after_final", jobId, number, "final=%d", seq.final)
+    }
+
+    switch {
+    case number == seq.next:
+        seq.next++
+    case number > seq.next:
+        warnSequence("gap", jobId, number, "missing_from=%d missing_to=%d", seq.next, number-1)
+        seq.missing = append(seq.missing, numberRange{seq.next, number - 1})
+        seq.next = number + 1
+    case seq.fill(number):
+        appMetrics.MarkLogPartSequence("out_of_order")
+    default:
+        warnSequence("duplicate", jobId, number, "next=%d", seq.next)
+    }
+
+    if final {
+        seq.final = number
+        seq.hasFinal = true
+    }
+}
+
+// sweep forgets the jobs not updated for ttl.
+func (st *SequenceTracker) sweep(now time.Time) {
+    for jobId, seq := range st.jobs {
+        if now.Sub(seq.updatedAt) <= st.ttl {
+            continue
+        }
+
+        if len(seq.missing) > 0 {
+            warnSequence("unfilled_gap", jobId, seq.next-1, "missing_count=%d", seq.missingCount())
+        }
+        delete(st.jobs, jobId)
+    }
+
+    st.lastSweep = now
+}
+
+// fill takes number out of the missing ranges, reporting whether it was
+// missing.
+func (seq *jobSequence) fill(number int) bool {
+    for i, r := range seq.missing {
+        if number < r.From || number > r.To {
+            continue
+        }
+
+        switch {
+        case r.From == r.To:
+            seq.missing = append(seq.missing[:i], seq.missing[i+1:]...)
+        case number == r.From:
+            seq.missing[i].From++
+        case number == r.To:
+            seq.missing[i].To--
+        default:
+            seq.missing = append(seq.missing[:i+1], seq.missing[i:]...)
+            seq.missing[i] = numberRange{r.From, number - 1}
+            seq.missing[i+1] = numberRange{number + 1, r.To}
+        }
+
+        return true
+    }
+
+    return false
+}
+
+func (seq *jobSequence) missingCount() int {
+    count := 0
+    for _, r := range seq.missing {
+        count += r.To - r.From + 1
+    }
+    return count
+}
+
+func warnSequence(event string, jobId int, number int, format string, args ...interface{}) {
+    appMetrics.MarkLogPartSequence(event)
+
+    args = append([]interface{}{event, jobId, number}, args...)
+    log.Printf("sequence: level=warn event=%s job_id=%d number=%d "+format, args...)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+    "reflect"
+    "testing"
+    "time"
+)
+
+func TestSequenceTrackerRanges(t *testing.T) {
+    tests := []struct {
+        name    string
+        numbers []int
+        next    int
+        missing []numberRange
+    }{
+        {"in order", []int{0, 1, 2}, 3, nil},
+        {"seeded from the first part number", []int{3}, 4, []numberRange{{0, 2}}},
+        {"gap ranges", []int{0, 3, 7}, 8, []numberRange{{1, 2}, {4, 6}}},
+        {"filling the start of a range", []int{0, 4, 1}, 5, []numberRange{{2, 3}}},
+        {"filling the end of a range", []int{0, 4, 3}, 5, []numberRange{{1, 2}}},
+        {"splitting a range", []int{0, 6, 3}, 7, []numberRange{{1, 2}, {4, 5}}},
+        {"removing a range of one", []int{0, 2, 1}, 3, nil},
+        {"filling split ranges up", []int{0, 6, 3, 1, 5, 2, 4}, 7, nil},
+        {"filling one of several ranges", []int{0, 3, 7, 5}, 8, []numberRange{{1, 2}, {4, 4}, {6, 6}}},
+        {"duplicates", []int{0, 1, 1, 0, 3, 3}, 4, []numberRange{{2, 2}}},
+    }
+
+    for _, test := range tests {
+        st := NewSequenceTracker(time.Hour)
+        for _, number := range test.numbers {
+            st.Track(1, number, false)
+        }
+
+        seq := st.jobs[1]
+        if seq.next != test.next {
+            t.Errorf("%s: expected next %d, got %d", test.name, test.next, seq.next)
+        }
+
+        missing := seq.missing
+        if len(missing) == 0 {
+            missing = nil
+        }
+        if !reflect.DeepEqual(missing, test.missing) {
+            t.Errorf("%s: expected missing %v, got %v", test.name, test.missing, missing)
+        }
+    }
+}
+
+func TestJobSequenceFill(t *testing.T) {
+    tests := []struct {
+        missing []numberRange
+        number  int
+        filled  bool
+        count   int
+    }{
+        {nil, 1, false, 0},
+        {[]numberRange{{1, 3}}, 0, false, 3},
+        {[]numberRange{{1, 3}}, 4, false, 3},
+        {[]numberRange{{1, 3}}, 1, true, 2},
+        {[]numberRange{{1, 3}}, 2, true, 2},
+        {[]numberRange{{1, 3}}, 3, true, 2},
+        {[]numberRange{{1, 1}, {3, 3}}, 3, true, 1},
+    }
+
+    for _, test := range tests {
+        seq := &jobSequence{missing: append([]numberRange{}, test.missing...)}
+
+        if filled := seq.fill(test.number); filled != test.filled {
+            t.Errorf("fill(%d) of %v = %v, expected %v", test.number, test.missing, filled, test.filled)
+        }
+        if count := seq.missingCount(); count != test.count {
+            t.Errorf("fill(%d) of %v left %d missing, expected %d", test.number, test.missing, count, test.count)
+        }
+    }
+}
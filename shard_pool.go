@@ -0,0 +1,157 @@
+package main
+
+import (
+    "errors"
+    "github.com/streadway/amqp"
+    "sync"
+    "sync/atomic"
+)
+
+const (
+    // shardReplicas is how often every worker is placed on the hash ring,
+    // spreading the keys evenly.
+    shardReplicas = 64
+
+    // shardBuffer is how many deliveries wait for a worker before the
+    // consumer handing them out blocks.
+    shardBuffer = 16
+)
+
+// ShardKeyer is implemented by MessageProcessors whose messages have to be
+// processed in order per key. Messages with the same key always go to the
+// same worker of a queue, across all of its subscriptions. The worker
+// processes them in the order they are dispatched, which for messages
+// consumed by different subscriptions is the order they happened to arrive
+// in, not necessarily the order they were published in.
+type ShardKeyer interface {
+    ShardKey(message []byte) (string, bool)
+}
+
+// shardPool is the pool of workers processing the messages of one queue.
+// The processors of each subscription join it as workers, and messages are
+// handed to them by consistent hashing of their shard key. Messages without
+// a key are spread round robin.
+type shardPool struct {
+    mu      sync.RWMutex
+    ring    *HashRing
+    workers map[int]*shardWorker
+    ids     []int
+    nextId  int
+    next    uint64
+}
+
+type shardWorker struct {
+    queue   chan shardedDelivery
+    sending sync.WaitGroup
+    done    chan struct{}
+}
+
+type shardedDelivery struct {
+    publisher *confirmPublisher
+    message   amqp.Delivery
+    wg        *sync.WaitGroup
+}
+
+func newShardPool() *shardPool {
+    return &shardPool{
+        ring:    NewHashRing(shardReplicas),
+        workers: map[int]*shardWorker{},
+    }
+}
+
+// join adds a worker processing deliveries with process, and returns its id.
+func (sp *shardPool) join(process func(*confirmPublisher, amqp.Delivery)) int {
+    worker := &shardWorker{queue: make(chan shardedDelivery, shardBuffer), done: make(chan struct{})}
+
+    go func() {
+        defer close(worker.done)
+
+        for d := range worker.queue {
+            process(d.publisher, d.message)
+            d.wg.Done()
+        }
+    }()
+
+    sp.mu.Lock()
+    defer sp.mu.Unlock()
+
+    id := sp.nextId
+    sp.nextId++
+
+    sp.workers[id] = worker
+    sp.ids = append(sp.ids, id)
+    sp.ring.Add(id)
+
+    return id
+}
+
+// leave removes a worker, and returns once it has processed the deliveries
+// already handed to it.
+func (sp *shardPool) leave(id int) {
+    sp.mu.Lock()
+
+    worker := sp.workers[id]
+    if worker == nil {
+        sp.mu.Unlock()
+        return
+    }
+
+    sp.ring.Remove(id)
+    delete(sp.workers, id)
+
+    for i, other := range sp.ids {
+        if other == id {
+            sp.ids = append(sp.ids[:i], sp.ids[i+1:]...)
+            break
+        }
+    }
+
+    sp.mu.Unlock()
+
+    // no dispatch picks the worker anymore, the ones already sending to it
+    // are waited for before its queue is closed
+    worker.sending.Wait()
+    close(worker.queue)
+
+    <-worker.done
+}
+
+var errNoShardWorkers = errors.New("no workers to dispatch to")
+
+// dispatch hands message to the worker for key, blocking while that worker
+// is busy. wg is done once the message has been processed.
+func (sp *shardPool) dispatch(key string, hasKey bool, publisher *confirmPublisher, message amqp.Delivery, wg *sync.WaitGroup) error {
+    worker := sp.pick(key, hasKey)
+    if worker == nil {
+        return errNoShardWorkers
+    }
+    defer worker.sending.Done()
+
+    wg.Add(1)
+    worker.queue <- shardedDelivery{publisher, message, wg}
+
+    return nil
+}
+
+// pick returns the worker for key, registered as being sent to so that it
+// doesn't leave meanwhile, or nil when the pool has no workers.
+func (sp *shardPool) pick(key string, hasKey bool) *shardWorker {
+    sp.mu.RLock()
+    defer sp.mu.RUnlock()
+
+    if len(sp.ids) == 0 {
+        return nil
+    }
+
+    var id int
+    if hasKey {
+        id, _ = sp.ring.Get(key)
+    } else {
+        id = sp.ids[atomic.AddUint64(&sp.next, 1)%uint64(len(sp.ids))]
+    }
+
+    worker := sp.workers[id]
+    worker.sending.Add(1)
+
+    return worker
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+    "github.com/streadway/amqp"
+    "strconv"
+    "sync"
+    "testing"
+)
+
+func TestShardPoolEmpty(t *testing.T) {
+    pool := newShardPool()
+
+    var wg sync.WaitGroup
+    if err := pool.dispatch("1", true, nil, amqp.Delivery{}, &wg); err != errNoShardWorkers {
+        t.Errorf("expected errNoShardWorkers from an empty pool, got %v", err)
+    }
+
+    id := pool.join(func(*confirmPublisher, amqp.Delivery) {})
+    pool.leave(id)
+
+    if err := pool.dispatch("1", false, nil, amqp.Delivery{}, &wg); err != errNoShardWorkers {
+        t.Errorf("expected errNoShardWorkers once the last worker left, got %v", err)
+    }
+}
+
+func TestShardPoolDispatchesKeysInOrder(t *testing.T) {
+    pool := newShardPool()
+
+    var mu sync.Mutex
+    workers := map[string]int{}
+    processed := map[string][]int{}
+
+    for i := 0; i < 4; i++ {
+        worker := i
+        pool.join(func(_ *confirmPublisher, message amqp.Delivery) {
+            mu.Lock()
+            defer mu.Unlock()
+
+            key := message.MessageId
+            if other, seen := workers[key]; seen && other != worker {
+                t.Errorf("key %s was processed by workers %d and %d", key, other, worker)
+            }
+            workers[key] = worker
+
+            number, _ := strconv.Atoi(string(message.Body))
+            processed[key] = append(processed[key], number)
+        })
+    }
+
+    var wg sync.WaitGroup
+    for number := 0; number < 50; number++ {
+        for job := 0; job < 20; job++ {
+            key := strconv.Itoa(job)
+            message := amqp.Delivery{MessageId: key, Body: []byte(strconv.Itoa(number))}
+            if err := pool.dispatch(key, true, nil, message, &wg); err != nil {
+                t.Fatal(err)
+            }
+        }
+    }
+    wg.Wait()
+
+    if len(workers) != 20 {
+        t.Fatalf("expected 20 keys to be processed, got %d", len(workers))
+    }
+
+    used := map[int]bool{}
+    for key, numbers := range processed {
+        used[workers[key]] = true
+
+        if len(numbers) != 50 {
+            t.Errorf("key %s: expected 50 messages, got %d", key, len(numbers))
+        }
+        for i, number := range numbers {
+            if number != i {
+                t.Errorf("key %s: expected message %d at %d, got the order %v", key, i, i, numbers)
+                break
+            }
+        }
+    }
+
+    if len(used) < 2 {
+        t.Errorf("expected the keys to be spread over the workers, got %d worker", len(used))
+    }
+}
+
+func TestShardPoolLeaveFinishesDispatched(t *testing.T) {
+    pool := newShardPool()
+
+    var mu sync.Mutex
+    processed := 0
+    id := pool.join(func(*confirmPublisher, amqp.Delivery) {
+        mu.Lock()
+        processed++
+        mu.Unlock()
+    })
+
+    var wg sync.WaitGroup
+    for i := 0; i < shardBuffer; i++ {
+        if err := pool.dispatch("", false, nil, amqp.Delivery{}, &wg); err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    pool.leave(id)
+
+    mu.Lock()
+    defer mu.Unlock()
+    if processed != shardBuffer {
+        t.Errorf("expected leave to wait for the %d dispatched messages, %d were processed", shardBuffer, processed)
+    }
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "github.com/gorilla/websocket"
+    "log"
+    "math/rand"
+    "net/http"
+    "strings"
+    "sync"
+    "time"
+)
+
+const (
+    wsMaxMessageSize = 64 * 1024
+    wsWriteTimeout   = 10 * time.Second
+
+    // pusherActivityTimeout is the idle time after which clients ping, a
+    // connection silent for twice as long is considered dead.
+    pusherActivityTimeout = 120
+)
+
+// WebSocketServer is a Pusher which speaks enough of the Pusher client
+// protocol for the existing browser clients to connect to it instead of
+// Pusher: they connect to /app/:key, subscribe to job-<id> channels and
+// receive job:log events. Only public channels are supported, and it only
+// sees the log parts processed by this process.
+type WebSocketServer struct {
+    key      string
+    upgrader websocket.Upgrader
+    mu       sync.Mutex
+    channels map[string]map[*wsConn]bool
+}
+
+type pusherEvent struct {
+    Event   string      `json:"event"`
+    Channel string      `json:"channel,omitempty"`
+    Data    interface{} `json:"data"`
+}
+
+type pusherClientEvent struct {
+    Event string `json:"event"`
+    Data  struct {
+        Channel string `json:"channel"`
+    } `json:"data"`
+}
+
+// NewWebSocketServer returns a WebSocketServer accepting clients for the
+// given app key, or for any key when it is empty. Browsers may only connect
+// from the given origins, "*" allowing any, or from the server's own host
+// when there are none.
+func NewWebSocketServer(key string, origins []string) *WebSocketServer {
+    s := &WebSocketServer{key: key, channels: map[string]map[*wsConn]bool{}}
+    s.upgrader = websocket.Upgrader{
+        ReadBufferSize:  4096,
+        WriteBufferSize: 4096,
+    }
+
+    if len(origins) > 0 {
+        s.upgrader.CheckOrigin = func(r *http.Request) bool {
+            return allowedOrigin(r.Header.Get("Origin"), origins)
+        }
+    }
+
+    return s
+}
+
+func allowedOrigin(origin string, origins []string) bool {
+    // requests without an Origin don't come from a browser
+    if origin == "" {
+        return true
+    }
+
+    for _, allowed := range origins {
+        if allowed == "*" || strings.EqualFold(allowed, origin) {
+            return true
+        }
+    }
+
+    return false
+}
+
+func (s *WebSocketServer) Publish(ctx context.Context, jobId int, number int, content string, final bool) error {
+    payload := PusherPayload{
+        JobId:   jobId,
+        Number:  number,
+        Content: content,
+        Final:   final,
+    }
+
+    data, err := json.Marshal(&payload)
+    if err != nil {
+        return fmt.Errorf("Publish: error during json.marshal: %v", err)
+    }
+
+    channel := fmt.Sprintf("job-%d", jobId)
+
+    // like Pusher the event data is a JSON encoded string
+    message, err := json.Marshal(&pusherEvent{"job:log", channel, string(data)})
+    if err != nil {
+        return fmt.Errorf("Publish: error during json.marshal: %v", err)
+    }
+
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    for conn := range s.channels[channel] {
+        conn.send(message)
+    }
+
+    return nil
+}
+
+func (s *WebSocketServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    key := strings.TrimPrefix(r.URL.Path, "/app/")
+    if s.key != "" && key != s.key {
+        http.NotFound(w, r)
+        return
+    }
+
+    // the upgrader answers failed handshakes itself
+    ws, err := s.upgrader.Upgrade(w, r, nil)
+    if err != nil {
+        log.Printf("ServeHTTP: websocket upgrade failed - %v", err)
+        return
+    }
+
+    s.serveConn(newWSConn(ws))
+}
+
+func (s *WebSocketServer) serveConn(conn *wsConn) {
+    defer conn.close()
+    defer s.unsubscribeAll(conn)
+
+    go conn.writeLoop()
+
+    socketId := fmt.Sprintf("%d.%d", rand.Int31(), rand.Int31())
+    conn.sendEvent(pusherEvent{"pusher:connection_established", "", jsonString(map[string]interface{}{
+        "socket_id":        socketId,
+        "activity_timeout": pusherActivityTimeout,
+    })})
+
+    for {
+        message, err := conn.readMessage()
+        if err != nil {
+            return
+        }
+
+        var event pusherClientEvent
+        if err = json.Unmarshal(message, &event); err != nil {
+            conn.sendEvent(pusherEvent{"pusher:error", "", map[string]interface{}{"code": nil, "message": "invalid JSON"}})
+            continue
+        }
+
+        switch event.Event {
+        case "pusher:ping":
+            conn.sendEvent(pusherEvent{"pusher:pong", "", "{}"})
+        case "pusher:subscribe":
+            channel := event.Data.Channel
+            if strings.HasPrefix(channel, "private-") || strings.HasPrefix(channel, "presence-") {
+                conn.sendEvent(pusherEvent{"pusher:error", "", map[string]interface{}{"code": nil, "message": "only public channels are supported"}})
+                continue
+            }
+            s.subscribe(conn, channel)
+            conn.sendEvent(pusherEvent{"pusher_internal:subscription_succeeded", channel, "{}"})
+        case "pusher:unsubscribe":
+            s.unsubscribe(conn, event.Data.Channel)
+        }
+    }
+}
+
+func (s *WebSocketServer) subscribe(conn *wsConn, channel string) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if s.channels[channel] == nil {
+        s.channels[channel] = map[*wsConn]bool{}
+    }
+    s.channels[channel][conn] = true
+}
+
+func (s *WebSocketServer) unsubscribe(conn *wsConn, channel string) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    s.removeSubscription(conn, channel)
+}
+
+func (s *WebSocketServer) unsubscribeAll(conn *wsConn) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    for channel := range s.channels {
+        s.removeSubscription(conn, channel)
+    }
+}
+
+func (s *WebSocketServer) removeSubscription(conn *wsConn, channel string) {
+    delete(s.channels[channel], conn)
+    if len(s.channels[channel]) == 0 {
+        delete(s.channels, channel)
+    }
+}
+
+func jsonString(v interface{}) string {
+    data, _ := json.Marshal(v)
+    return string(data)
+}
+
+// wsConn queues the messages for a websocket connection, so that a slow
+// client never holds up publishing.
+type wsConn struct {
+    ws        *websocket.Conn
+    outgoing  chan []byte
+    done      chan struct{}
+    closeOnce sync.Once
+}
+
+func newWSConn(ws *websocket.Conn) *wsConn {
+    ws.SetReadLimit(wsMaxMessageSize)
+
+    return &wsConn{
+        ws:       ws,
+        outgoing: make(chan []byte, subscriberBuffer),
+        done:     make(chan struct{}),
+    }
+}
+
+// send queues a text message, a client too slow to keep up is disconnected.
+func (c *wsConn) send(message []byte) {
+    select {
+    case c.outgoing <- message:
+    case <-c.done:
+    default:
+        c.close()
+    }
+}
+
+func (c *wsConn) sendEvent(event pusherEvent) {
+    message, err := json.Marshal(&event)
+    if err != nil {
+        log.Printf("sendEvent: error during json.marshal - %v", err)
+        return
+    }
+    c.send(message)
+}
+
+func (c *wsConn) writeLoop() {
+    for {
+        select {
+        case message := <-c.outgoing:
+            c.ws.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+            if err := c.ws.WriteMessage(websocket.TextMessage, message); err != nil {
+                c.close()
+                return
+            }
+        case <-c.done:
+            return
+        }
+    }
+}
+
+// readMessage returns the next message, websocket control frames are
+// answered while reading.
+func (c *wsConn) readMessage() ([]byte, error) {
+    c.ws.SetReadDeadline(time.Now().Add(2 * pusherActivityTimeout * time.Second))
+
+    _, message, err := c.ws.ReadMessage()
+    return message, err
+}
+
+func (c *wsConn) close() {
+    c.closeOnce.Do(func() {
+        close(c.done)
+        c.ws.Close()
+    })
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "github.com/gorilla/websocket"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+)
+
+func startTestWebSocketServer(origins []string) (*WebSocketServer, *httptest.Server, string) {
+    ws := NewWebSocketServer("key", origins)
+    server := httptest.NewServer(ws)
+
+    return ws, server, "ws" + strings.TrimPrefix(server.URL, "http") + "/app/key"
+}
+
+func dialTestWebSocket(t *testing.T, url string, header http.Header) *websocket.Conn {
+    conn, _, err := websocket.DefaultDialer.Dial(url, header)
+    if err != nil {
+        t.Fatalf("dial failed: %v", err)
+    }
+
+    return conn
+}
+
+func readTestEvent(t *testing.T, conn *websocket.Conn) pusherEvent {
+    conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+    var event pusherEvent
+    if err := conn.ReadJSON(&event); err != nil {
+        t.Fatalf("reading event failed: %v", err)
+    }
+
+    return event
+}
+
+func subscribeTestWebSocket(t *testing.T, conn *websocket.Conn, channel string) pusherEvent {
+    subscribe := map[string]interface{}{"event": "pusher:subscribe", "data": map[string]string{"channel": channel}}
+    if err := conn.WriteJSON(subscribe); err != nil {
+        t.Fatalf("subscribing failed: %v", err)
+    }
+
+    return readTestEvent(t, conn)
+}
+
+func TestWebSocketServerPublishesToSubscribers(t *testing.T) {
+    ws, server, url := startTestWebSocketServer(nil)
+    defer server.Close()
+
+    conn := dialTestWebSocket(t, url, nil)
+    defer conn.Close()
+
+    if event := readTestEvent(t, conn); event.Event != "pusher:connection_established" {
+        t.Fatalf("expected pusher:connection_established, got %q", event.Event)
+    }
+
+    if event := subscribeTestWebSocket(t, conn, "job-1"); event.Event != "pusher_internal:subscription_succeeded" || event.Channel != "job-1" {
+        t.Fatalf("expected the subscription to job-1 to succeed, got %q on %q", event.Event, event.Channel)
+    }
+
+    if err := ws.Publish(context.Background(), 2, 0, "other job", false); err != nil {
+        t.Fatal(err)
+    }
+    if err := ws.Publish(context.Background(), 1, 3, "hello", true); err != nil {
+        t.Fatal(err)
+    }
+
+    event := readTestEvent(t, conn)
+    if event.Event != "job:log" || event.Channel != "job-1" {
+        t.Fatalf("expected job:log on job-1, got %q on %q", event.Event, event.Channel)
+    }
+
+    data, ok := event.Data.(string)
+    if !ok {
+        t.Fatalf("expected the event data to be a JSON string, got %T", event.Data)
+    }
+
+    var payload PusherPayload
+    if err := json.Unmarshal([]byte(data), &payload); err != nil {
+        t.Fatal(err)
+    }
+
+    expected := PusherPayload{JobId: 1, Number: 3, Content: "hello", Final: true}
+    if payload.JobId != expected.JobId || payload.Number != expected.Number || payload.Content != expected.Content || payload.Final != expected.Final {
+        t.Errorf("expected %+v, got %+v", expected, payload)
+    }
+}
+
+func TestWebSocketServerRejectsPrivateChannels(t *testing.T) {
+    _, server, url := startTestWebSocketServer(nil)
+    defer server.Close()
+
+    conn := dialTestWebSocket(t, url, nil)
+    defer conn.Close()
+    readTestEvent(t, conn)
+
+    for _, channel := range []string{"private-job-1", "presence-job-1"} {
+        if event := subscribeTestWebSocket(t, conn, channel); event.Event != "pusher:error" {
+            t.Errorf("expected subscribing to %s to fail, got %q", channel, event.Event)
+        }
+    }
+}
+
+func TestWebSocketServerAnswersPings(t *testing.T) {
+    _, server, url := startTestWebSocketServer(nil)
+    defer server.Close()
+
+    conn := dialTestWebSocket(t, url, nil)
+    defer conn.Close()
+    readTestEvent(t, conn)
+
+    if err := conn.WriteJSON(map[string]interface{}{"event": "pusher:ping", "data": map[string]string{}}); err != nil {
+        t.Fatal(err)
+    }
+
+    if event := readTestEvent(t, conn); event.Event != "pusher:pong" {
+        t.Errorf("expected pusher:pong, got %q", event.Event)
+    }
+}
+
+func TestWebSocketServerChecksTheAppKey(t *testing.T) {
+    _, server, url := startTestWebSocketServer(nil)
+    defer server.Close()
+
+    _, resp, err := websocket.DefaultDialer.Dial(strings.TrimSuffix(url, "key")+"other", nil)
+    if err == nil {
+        t.Fatal("expected connecting with another app key to fail")
+    }
+    if resp == nil || resp.StatusCode != http.StatusNotFound {
+        t.Errorf("expected a 404 response, got %v", resp)
+    }
+}
+
+func TestWebSocketServerChecksTheOrigin(t *testing.T) {
+    tests := []struct {
+        origins []string
+        origin  string
+        allowed bool
+    }{
+        {nil, "http://evil.example", false},
+        {[]string{"https://travis-ci.org"}, "https://travis-ci.org", true},
+        {[]string{"https://travis-ci.org"}, "https://TRAVIS-CI.org", true},
+        {[]string{"https://travis-ci.org"}, "http://evil.example", false},
+        {[]string{"*"}, "http://evil.example", true},
+    }
+
+    for _, test := range tests {
+        _, server, url := startTestWebSocketServer(test.origins)
+
+        conn, resp, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {test.origin}})
+        if conn != nil {
+            conn.Close()
+        }
+        server.Close()
+
+        if test.allowed && err != nil {
+            t.Errorf("origins %v: expected %s to be allowed, got %v", test.origins, test.origin, err)
+        }
+        if !test.allowed && (err == nil || resp == nil || resp.StatusCode != http.StatusForbidden) {
+            t.Errorf("origins %v: expected %s to be forbidden, got %v", test.origins, test.origin, err)
+        }
+    }
+}